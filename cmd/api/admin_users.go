@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// Impersonation tokens are short-lived, and can't be refreshed.
+const impersonationTTL = 30 * time.Minute
+
+// The listUsersHandler() lets an administrator search for the members of their
+// organization by name or email address.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "q", "")
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Sort = app.readString(qs, "sort", "id")
+
+	input.SortSafelist = []string{
+		"id",
+		"name",
+		"email",
+		"created_at",
+		"-id",
+		"-name",
+		"-email",
+		"-created_at",
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(app.contextGetOrganization(r), input.Search, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserHandler() shows an administrator a user's details, along with their roles
+// and effective permissions in the administrator's organization.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	orgID := app.contextGetOrganization(r)
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	env := envelope{"user": user, "roles": roles, "permissions": permissions}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The activateUserByAdminHandler() lets an administrator activate a user's account
+// without the user following the link in their activation email, for example if they
+// have confirmed the user's email address some other way.
+func (app *application) activateUserByAdminHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readManagedUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	before := *user
+	user.Activated = true
+
+	// The user's activation tokens aren't needed any more.
+	ok = app.updateUserByAdmin(w, r, "user.activate", &before, user, func(tx data.Models, log *auditLog) error {
+		err := tx.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, scopeAudit(data.ScopeActivation), nil)
+	})
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deactivateUserHandler() lets an administrator stop a user from using their
+// account. The user is logged out everywhere (including any signed access tokens they
+// hold), their API keys stop working, and they can't log in again until their account
+// is reactivated.
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readManagedUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	// Don't let administrators lock themselves out by mistake.
+	if user.ID == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("user", "must not be yourself")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	before := *user
+	user.Deactivated = true
+
+	ok = app.updateUserByAdmin(w, r, "user.deactivate", &before, user, func(tx data.Models, log *auditLog) error {
+		families, err := tx.Tokens.DeleteAllSessionsForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = app.revokeTokenFamilies(tx, families)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, map[string]any{"sessions": "all"}, nil)
+	})
+	if !ok {
+		return
+	}
+
+	app.logger.Info("user deactivated", "admin_id", app.contextGetUser(r).ID, "user_id", user.ID)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The reactivateUserHandler() lets an administrator undo deactivateUserHandler(), so
+// that the user can log in again.
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readManagedUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	before := *user
+	user.Deactivated = false
+
+	if !app.updateUserByAdmin(w, r, "user.reactivate", &before, user, nil) {
+		return
+	}
+
+	app.logger.Info("user reactivated", "admin_id", app.contextGetUser(r).ID, "user_id", user.ID)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteUserSessionsHandler() lets an administrator log a user out everywhere, for
+// example if their account may have been compromised. As with deactivation, their
+// signed access tokens are revoked too.
+func (app *application) deleteUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readManagedUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		families, err := tx.Tokens.DeleteAllSessionsForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = app.revokeTokenFamilies(tx, families)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, map[string]any{"sessions": "all"}, nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("user logged out by administrator", "admin_id", app.contextGetUser(r).ID, "user_id", user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createImpersonationHandler() issues an administrator with a short-lived token
+// which lets them act as another user, to help investigate problems that the user is
+// having. The administrator has to give a reason, which is recorded along with the
+// impersonation, and every request made with the token is logged.
+func (app *application) createImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, ok := app.readManagedUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	impersonation := &data.Impersonation{
+		AdminID: admin.ID,
+		UserID:  user.ID,
+		Reason:  input.Reason,
+		IP:      realip.FromRequest(r),
+		Expiry:  time.Now().Add(impersonationTTL),
+	}
+
+	v := validator.New()
+
+	data.ValidateImpersonation(v, impersonation)
+
+	v.Check(!user.Deactivated, "user", "must not be deactivated")
+
+	// Impersonating another administrator would let an administrator act with
+	// somebody else's authority, so it isn't allowed. The user may be an administrator
+	// of an organization that the impersonating administrator doesn't belong to, so
+	// every organization is checked.
+	isAdmin, err := app.models.Permissions.HeldInAnyOrganization(user.ID, "users:admin")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v.Check(!isAdmin, "user", "must not be an administrator")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var token *data.Token
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		var err error
+
+		token, err = tx.Tokens.NewImpersonation(user.ID, impersonationTTL, admin.ID)
+		if err != nil {
+			return err
+		}
+
+		impersonation.Expiry = token.Expiry
+
+		err = tx.Impersonations.Insert(impersonation)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Warn(
+		"impersonation started",
+		"admin_id", admin.ID,
+		"user_id", user.ID,
+		"reason", impersonation.Reason,
+		"ip", impersonation.IP,
+	)
+
+	env := envelope{"impersonation": impersonation, "authentication_token": token}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserIDParam() helper looks up the user whose ID is given in the URL. Only
+// members of the organization that the request acts in can be looked up, so that
+// administrators can't manage users outside their own organization. If there is no
+// such user, or something goes wrong, it sends an error response and returns false.
+func (app *application) readUserIDParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	member, err := app.models.Organizations.IsMember(app.contextGetOrganization(r), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !member {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// The readManagedUserParam() helper looks up the user whose ID is given in the URL, like
+// readUserIDParam(), for actions which change the user's account as a whole rather
+// than their membership of one organization (such as deactivating them or logging them
+// out). As these affect every organization that the user belongs to, the administrator
+// must hold the users:admin permission in each of them. If they don't, or something
+// goes wrong, it sends an error response and returns false.
+func (app *application) readManagedUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	orgs, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	admin := app.contextGetUser(r)
+	orgID := app.contextGetOrganization(r)
+
+	for _, org := range orgs {
+		// requirePermission() has already checked the organization that the request
+		// acts in.
+		if org.ID == orgID {
+			continue
+		}
+
+		permissions, err := app.userPermissions(admin.ID, org.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
+
+		if !permissions.Include("users:admin") {
+			app.notPermittedResponse(w, r)
+			return nil, false
+		}
+	}
+
+	return user, true
+}
+
+// The updateUserByAdmin() helper saves changes that an administrator has made to a
+// user, recording them in the audit log as the given action. If also isn't nil, it is
+// called to make any related changes in the same transaction. If something goes wrong,
+// it sends an error response and returns false.
+func (app *application) updateUserByAdmin(
+	w http.ResponseWriter,
+	r *http.Request,
+	action string,
+	before, user *data.User,
+	also func(tx data.Models, log *auditLog) error,
+) bool {
+	// Deactivated users don't count as administrators, so make sure that the change
+	// doesn't leave an organization without one.
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := app.guardLastAdmin(tx, func() error {
+			return tx.Users.Update(user)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = log.record(action, "user", user.ID, before, user)
+		if err != nil {
+			return err
+		}
+
+		if also == nil {
+			return nil
+		}
+
+		return also(tx, log)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "user")
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
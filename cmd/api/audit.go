@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// An auditLog collects the audit events for the changes made while handling a
+// request. Each event records who made the request, acting in which organization,
+// from where, along with what was changed.
+type auditLog struct {
+	request data.AuditEvent
+	events  []*data.AuditEvent
+}
+
+// The record() method adds an event to the log. The before and after values are the
+// state of the resource before and after the change, which are encoded as JSON; before
+// should be nil for a creation, and after nil for a deletion. They must never contain
+// secrets, such as token plaintexts or password hashes.
+func (l *auditLog) record(action, resourceType string, resourceID any, before, after any) error {
+	event := l.request
+	event.Action = action
+	event.ResourceType = resourceType
+	event.ResourceID = fmt.Sprint(resourceID)
+
+	for _, state := range []struct {
+		value any
+		dst   *json.RawMessage
+	}{{before, &event.Before}, {after, &event.After}} {
+		if state.value == nil {
+			continue
+		}
+
+		js, err := json.Marshal(state.value)
+		if err != nil {
+			return err
+		}
+
+		*state.dst = js
+	}
+
+	l.events = append(l.events, &event)
+	return nil
+}
+
+// The setActor() method records the user that changes were made for as the actor, if
+// the request is anonymous (such as when a user signs up, or resets their password).
+func (l *auditLog) setActor(userID int64) {
+	if l.request.ActorID == 0 {
+		l.request.ActorID = userID
+	}
+}
+
+// The setOrganization() method records the organization that changes were made in, if
+// the request doesn't act in one (such as when a user signs up).
+func (l *auditLog) setOrganization(orgID int64) {
+	if l.request.OrgID == 0 {
+		l.request.OrgID = orgID
+	}
+}
+
+// The audit() helper runs fn in a database transaction, and inserts the audit events
+// that it records in the same transaction, so that a change is never made without
+// being recorded (or recorded without being made). fn must make its changes through
+// the models that it is given. If fn returns an error, the transaction is rolled back
+// and the error is returned unchanged.
+func (app *application) audit(r *http.Request, fn func(tx data.Models, log *auditLog) error) error {
+	log := &auditLog{
+		request: data.AuditEvent{
+			ImpersonatorID: app.contextGetImpersonator(r),
+			OrgID:          app.contextGetOrganization(r),
+			IP:             realip.FromRequest(r),
+			RequestID:      app.contextGetRequestID(r),
+		},
+	}
+
+	if user, ok := r.Context().Value(userContextKey).(*data.User); ok && !user.IsAnonymous() {
+		log.request.ActorID = user.ID
+	}
+
+	return app.models.Transaction(func(tx data.Models) error {
+		err := fn(tx, log)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range log.events {
+			err := tx.Audit.Insert(event)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// The tokenAudit() helper returns the details of a token which are recorded in the
+// audit log. The token itself is never recorded. Token events use the ID of the user
+// that the token belongs to as the resource ID.
+func tokenAudit(token *data.Token) map[string]any {
+	details := map[string]any{
+		"scope":  token.Scope,
+		"expiry": token.Expiry,
+	}
+
+	if token.Family != "" {
+		details["family"] = token.Family
+	}
+
+	if token.ClientID != 0 {
+		details["client_id"] = token.ClientID
+	}
+
+	if token.ImpersonatorID != 0 {
+		details["impersonator_id"] = token.ImpersonatorID
+	}
+
+	return details
+}
+
+// The scopeAudit() helper returns the details recorded in the audit log when all of a
+// user's tokens with a scope are deleted.
+func scopeAudit(scope string) map[string]any {
+	return map[string]any{"scope": scope}
+}
+
+// The permissionsAudit() helper returns the details recorded in the audit log when
+// permissions are granted to or revoked from a user in an organization. Permission
+// events use the ID of the user as the resource ID.
+func permissionsAudit(orgID int64, codes ...string) map[string]any {
+	return map[string]any{"org_id": orgID, "permissions": codes}
+}
+
+// The listAuditEventsHandler() returns a page of the audit events recorded in the
+// organization that the request acts in, newest first by default. Users who can
+// administer organizations can see the events in every organization (including those
+// which don't belong to one, such as sign-ups and logins), or choose an organization
+// with the org_id parameter.
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	v.Check(input.ActorID >= 0, "actor_id", "must be a positive integer")
+
+	input.Action = app.readString(qs, "action", "")
+	input.ResourceType = app.readString(qs, "resource_type", "")
+	input.ResourceID = app.readString(qs, "resource_id", "")
+
+	input.Since = app.readTime(qs, "since", v)
+	input.Until = app.readTime(qs, "until", v)
+
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-created_at")
+	input.SortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	input.OrgID = app.contextGetOrganization(r)
+
+	if permissions.Include("organizations:admin") {
+		input.OrgID = int64(app.readInt(qs, "org_id", 0, v))
+		v.Check(input.OrgID >= 0, "org_id", "must be a positive integer")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The cleanupAuditLog() method starts a background goroutine which periodically
+// removes audit events older than the configured retention period. If the retention
+// period is 0, events are kept forever.
+func (app *application) cleanupAuditLog(interval time.Duration) {
+	if app.config.audit.retention <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			deleted, err := app.models.Audit.DeleteOlderThan(time.Now().Add(-app.config.audit.retention))
+			if err != nil {
+				app.logger.Error(err.Error())
+				continue
+			}
+
+			if deleted > 0 {
+				app.logger.Info("old audit events deleted", "count", deleted)
+			}
+		}
+	}()
+}
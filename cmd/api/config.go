@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -12,7 +14,11 @@ import (
 type config struct {
 	port int
 	env  string
-	db   struct {
+
+	// The public base URL of the API, used to build links included in emails.
+	baseURL string
+
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -22,10 +28,38 @@ type config struct {
 	// Add a new limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting
 	// altogether.
+	//
+	// Every request is limited per IP address before it is authenticated: by rps and
+	// burst if it has no credentials, or by ipRPS and ipBurst (which should allow for
+	// several users sharing an address) if it has. Authenticated requests are then
+	// also limited per user (userRPS and userBurst) or per API key (apiKeyRPS and
+	// apiKeyBurst). Routes can override these limits or be exempt from them.
+	//
+	// The limiter's state, and that of the email and two-factor throttles, is kept in
+	// store: "memory" (each instance has its own limits), "postgres" (shared through the
+	// database) or "redis" (shared through a server speaking the Redis protocol at
+	// redisAddr).
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
+
+		ipRPS       float64
+		ipBurst     int
+		userRPS     float64
+		userBurst   int
+		apiKeyRPS   float64
+		apiKeyBurst int
+		routes      []string
+
+		store         string
+		redisAddr     string
+		redisPassword string
+
+		// The emailInterval and emailBurst fields control how often we are willing to
+		// send an email to the same address, regardless of which client asks for it.
+		emailInterval time.Duration
+		emailBurst    int
 	}
 
 	smtp struct {
@@ -36,10 +70,70 @@ type config struct {
 		sender   string
 	}
 
+	// The argon2id parameters used to hash new passwords. Memory is measured in KiB.
+	// At most maxConcurrent passwords are hashed at once, which bounds the memory that
+	// hashing can use to maxConcurrent * memory.
+	//
+	// New passwords must reach minStrength (from 0 to 4) and, if breachedFile is set,
+	// must not appear in the breached password corpus that it points to.
+	password struct {
+		memory        uint
+		iterations    uint
+		parallelism   uint
+		maxConcurrent int
+		minStrength   int
+		breachedFile  string
+	}
+
+	// Authorization rules are loaded from policyFile. If it isn't set, the built-in
+	// default policy is used. See internal/policy/examples for sample policies.
+	policyFile string
+
+	// Personal data exports are written to dir, and can be downloaded for ttl.
+	export struct {
+		dir string
+		ttl time.Duration
+	}
+
+	// Audit events are kept for retention, or forever if it is 0.
+	audit struct {
+		retention time.Duration
+	}
+
 	// Configure CORRS
 	cors struct {
 		trustedOrigins []string
 	}
+
+	// The lifetimes of the access and refresh tokens issued when a user logs in. Access
+	// tokens are kept short-lived so that a leaked token is only useful for a little
+	// while, and the refresh token is used to obtain new ones.
+	//
+	// In stateless mode, access tokens are issued as signed JWTs which carry the user's
+	// ID, activation state and permissions, so authenticating a request doesn't need the
+	// database. The first signing key is used to sign new tokens, and all of them are
+	// accepted when verifying, which allows keys to be rotated.
+	//
+	// After lockoutThreshold failed login attempts, an account is locked for
+	// lockoutDuration (or until an administrator unlocks it).
+	//
+	// Users' permissions are cached for up to permissionCacheTTL (0 disables the
+	// cache). Cached entries are normally invalidated straight away when they change.
+	//
+	// Two-factor authentication secrets are encrypted before they're stored. As with
+	// the signing keys, the first TOTP key is used to encrypt and all of them can decrypt.
+	auth struct {
+		accessTokenTTL   time.Duration
+		refreshTokenTTL  time.Duration
+		stateless        bool
+		signingKeys      []string
+		totpKeys         []string
+		denylistInterval time.Duration
+		lockoutThreshold int
+		lockoutDuration  time.Duration
+
+		permissionCacheTTL time.Duration
+	}
 }
 
 func loadConfig() (config, bool) {
@@ -51,6 +145,13 @@ func loadConfig() (config, bool) {
 		os.Getenv("ENV"),
 		"Environment (development|staging|production)",
 	)
+	flag.StringVar(
+		&cfg.baseURL,
+		"base-url",
+		getStringEnvVar("BASE_URL", "http://localhost:4000"),
+		"Public base URL of the API",
+	)
+
 	// Read the DSN value from the db-dsn command-line flag into the config struct. We
 	// default to using our development DSN if no flag is provided.
 	// Use the value of the GREENLIGHT_DB_DSN environment variable as the default value
@@ -72,6 +173,72 @@ func loadConfig() (config, bool) {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.Float64Var(
+		&cfg.limiter.ipRPS,
+		"limiter-ip-rps",
+		40,
+		"Rate limiter maximum requests per second from each IP address for requests with credentials",
+	)
+	flag.IntVar(
+		&cfg.limiter.ipBurst,
+		"limiter-ip-burst",
+		80,
+		"Rate limiter maximum burst from each IP address for requests with credentials",
+	)
+	flag.Float64Var(
+		&cfg.limiter.userRPS,
+		"limiter-user-rps",
+		10,
+		"Rate limiter maximum requests per second for each authenticated user",
+	)
+	flag.IntVar(
+		&cfg.limiter.userBurst,
+		"limiter-user-burst",
+		20,
+		"Rate limiter maximum burst for each authenticated user",
+	)
+	flag.Float64Var(
+		&cfg.limiter.apiKeyRPS,
+		"limiter-api-key-rps",
+		20,
+		"Rate limiter maximum requests per second for each API key",
+	)
+	flag.IntVar(
+		&cfg.limiter.apiKeyBurst,
+		"limiter-api-key-burst",
+		40,
+		"Rate limiter maximum burst for each API key",
+	)
+	flag.StringVar(
+		&cfg.limiter.store,
+		"limiter-store",
+		getStringEnvVar("LIMITER_STORE", "memory"),
+		"Where rate limiter state is kept (memory|postgres|redis)",
+	)
+	flag.StringVar(
+		&cfg.limiter.redisAddr,
+		"limiter-redis-addr",
+		getStringEnvVar("LIMITER_REDIS_ADDR", "localhost:6379"),
+		"Address of the Redis-protocol server used by the redis rate limiter store",
+	)
+	flag.StringVar(
+		&cfg.limiter.redisPassword,
+		"limiter-redis-password",
+		os.Getenv("LIMITER_REDIS_PASSWORD"),
+		"Password for the Redis-protocol server used by the redis rate limiter store",
+	)
+	flag.DurationVar(
+		&cfg.limiter.emailInterval,
+		"limiter-email-interval",
+		5*time.Minute,
+		"Minimum interval between emails sent to the same address",
+	)
+	flag.IntVar(
+		&cfg.limiter.emailBurst,
+		"limiter-email-burst",
+		2,
+		"Maximum burst of emails sent to the same address",
+	)
 
 	// Read the SMTP server configuration settings into the config struct, using the
 	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
@@ -88,6 +255,71 @@ func loadConfig() (config, bool) {
 		"SMTP sender",
 	)
 
+	flag.UintVar(
+		&cfg.password.memory,
+		"password-argon2-memory",
+		64*1024,
+		"Memory used to hash passwords with argon2id (KiB)",
+	)
+	flag.UintVar(
+		&cfg.password.iterations,
+		"password-argon2-iterations",
+		3,
+		"Number of argon2id iterations used to hash passwords",
+	)
+	flag.UintVar(
+		&cfg.password.parallelism,
+		"password-argon2-parallelism",
+		2,
+		"Degree of parallelism used to hash passwords with argon2id",
+	)
+	flag.IntVar(
+		&cfg.password.maxConcurrent,
+		"password-max-concurrent",
+		getIntEnvVar("PASSWORD_MAX_CONCURRENT", runtime.NumCPU()),
+		"Maximum number of passwords hashed at once",
+	)
+
+	flag.IntVar(
+		&cfg.password.minStrength,
+		"password-min-strength",
+		getIntEnvVar("PASSWORD_MIN_STRENGTH", 2),
+		"Minimum strength score for new passwords (0-4)",
+	)
+	flag.StringVar(
+		&cfg.password.breachedFile,
+		"password-breached-file",
+		os.Getenv("PASSWORD_BREACHED_FILE"),
+		"Path to a sorted file of SHA-1 hashes of breached passwords",
+	)
+
+	flag.StringVar(
+		&cfg.policyFile,
+		"policy-file",
+		os.Getenv("POLICY_FILE"),
+		"Path to a JSON authorization policy (the built-in policy is used if empty)",
+	)
+
+	flag.StringVar(
+		&cfg.export.dir,
+		"export-dir",
+		getStringEnvVar("EXPORT_DIR", filepath.Join(os.TempDir(), "greenlight-exports")),
+		"Directory to store personal data exports in",
+	)
+	flag.DurationVar(
+		&cfg.export.ttl,
+		"export-ttl",
+		24*time.Hour,
+		"How long personal data exports can be downloaded for",
+	)
+
+	flag.DurationVar(
+		&cfg.audit.retention,
+		"audit-retention",
+		365*24*time.Hour,
+		"How long audit events are kept for (0 keeps them forever)",
+	)
+
 	// Use the flag.Func() function to process the -cors-trusted-origins command line
 	// flag. In this we use the strings.Fields() function to split the flag value into a
 	// slice based on whitespace characters and assign it to our config struct.
@@ -106,6 +338,90 @@ func loadConfig() (config, bool) {
 		},
 	)
 
+	flag.DurationVar(
+		&cfg.auth.accessTokenTTL,
+		"auth-access-token-ttl",
+		15*time.Minute,
+		"Lifetime of authentication (access) tokens",
+	)
+	flag.DurationVar(
+		&cfg.auth.refreshTokenTTL,
+		"auth-refresh-token-ttl",
+		30*24*time.Hour,
+		"Lifetime of refresh tokens",
+	)
+
+	flag.BoolVar(
+		&cfg.auth.stateless,
+		"auth-stateless",
+		getBoolEnvVar("AUTH_STATELESS", false),
+		"Issue signed stateless access tokens",
+	)
+	flag.DurationVar(
+		&cfg.auth.denylistInterval,
+		"auth-denylist-interval",
+		30*time.Second,
+		"Interval between reloads of the revoked token denylist",
+	)
+
+	flag.IntVar(
+		&cfg.auth.lockoutThreshold,
+		"auth-lockout-threshold",
+		10,
+		"Number of failed login attempts after which an account is locked",
+	)
+	flag.DurationVar(
+		&cfg.auth.lockoutDuration,
+		"auth-lockout-duration",
+		time.Hour,
+		"How long an account stays locked after too many failed login attempts",
+	)
+
+	flag.DurationVar(
+		&cfg.auth.permissionCacheTTL,
+		"auth-permission-cache-ttl",
+		time.Minute,
+		"How long users' permissions are cached for (0 disables the cache)",
+	)
+
+	var signingKeysFlagSet bool
+
+	flag.Func(
+		"auth-signing-keys",
+		"Token signing keys as <kid>:<base64 seed> (space separated, first is used to sign)",
+		func(val string) error {
+			cfg.auth.signingKeys = strings.Fields(val)
+			signingKeysFlagSet = true
+			return nil
+		},
+	)
+
+	var totpKeysFlagSet bool
+
+	flag.Func(
+		"auth-totp-keys",
+		"TOTP secret encryption keys as <kid>:<base64 key> (space separated, first is used to encrypt)",
+		func(val string) error {
+			cfg.auth.totpKeys = strings.Fields(val)
+			totpKeysFlagSet = true
+			return nil
+		},
+	)
+
+	// Routes which authenticate with a password or a one-time code get a much stricter
+	// limit by default, and the healthcheck isn't limited at all.
+	var limiterRoutesFlagSet bool
+
+	flag.Func(
+		"limiter-routes",
+		"Rate limit route overrides as <method>:<path>=<rps>:<burst> or <method>:<path>=exempt (space separated)",
+		func(val string) error {
+			cfg.limiter.routes = strings.Fields(val)
+			limiterRoutesFlagSet = true
+			return nil
+		},
+	)
+
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -115,6 +431,23 @@ func loadConfig() (config, bool) {
 		cfg.cors.trustedOrigins = getStringListEnvVar("CORS_TRUSTED_ORIGINS")
 	}
 
+	if !signingKeysFlagSet {
+		cfg.auth.signingKeys = getStringListEnvVar("AUTH_SIGNING_KEYS")
+	}
+
+	if !totpKeysFlagSet {
+		cfg.auth.totpKeys = getStringListEnvVar("AUTH_TOTP_KEYS")
+	}
+
+	if !limiterRoutesFlagSet {
+		cfg.limiter.routes = getStringListEnvVar("LIMITER_ROUTES", ",", []string{
+			"POST:/v1/tokens/authentication=0.1:5",
+			"POST:/v1/tokens/mfa=0.1:5",
+			"POST:/v1/tokens/magic-link/exchange=0.1:5",
+			"GET:/v1/healthcheck=exempt",
+		})
+	}
+
 	return cfg, *displayVersion
 }
 
@@ -135,6 +468,34 @@ func getIntEnvVar(key string, defaultValue int) int {
 	return valInt
 }
 
+// getStringEnvVar reads the environment variable with the given key. If the variable
+// does not exist or is empty, it returns the default value.
+func getStringEnvVar(key string, defaultValue string) string {
+	valStr, exists := os.LookupEnv(key)
+	if !exists || valStr == "" {
+		return defaultValue
+	}
+
+	return valStr
+}
+
+// getBoolEnvVar reads the environment variable with the given key and parses it as a
+// bool. If the variable does not exist or cannot be parsed, it returns the default
+// value.
+func getBoolEnvVar(key string, defaultValue bool) bool {
+	valStr, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	valBool, err := strconv.ParseBool(valStr)
+	if err != nil {
+		return defaultValue
+	}
+
+	return valBool
+}
+
 // getStringListEnvVar reads an environment variable by key, splits it into a list of strings,
 // using a separator (defaults to ",") and a default value (defaults to an empty list if not provided).
 //
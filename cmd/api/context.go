@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/jwt"
 )
 
 // Define a custom contextKey type, with the underlying type string.
@@ -15,6 +16,39 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The tokenContextKey is used to store the plaintext authentication token that the
+// request was made with, so that handlers can act on the current session.
+const tokenContextKey = contextKey("token")
+
+// The claimsContextKey is used to store the claims of a signed token, when the request
+// was authenticated with one.
+const claimsContextKey = contextKey("claims")
+
+// The permissionsContextKey is used to store the permissions that a request was
+// granted at authentication time. When it is present, the requirePermission()
+// middleware uses it instead of looking up the user's permissions in the database.
+const permissionsContextKey = contextKey("permissions")
+
+// The apiKeyContextKey is used to store the ID of the API key that the request was
+// authenticated with, if any.
+const apiKeyContextKey = contextKey("api_key")
+
+// The oauthClientContextKey is used to store the ID of the OAuth client that the
+// request's token was issued to, if any.
+const oauthClientContextKey = contextKey("oauth_client")
+
+// The organizationContextKey is used to store the ID of the organization that an
+// authenticated request acts in.
+const organizationContextKey = contextKey("organization")
+
+// The impersonatorContextKey is used to store the ID of the administrator who is
+// impersonating the user, when the request was made with an impersonation token.
+const impersonatorContextKey = contextKey("impersonator")
+
+// The requestIDContextKey is used to store the ID that identifies the request in logs
+// and audit events.
+const requestIDContextKey = contextKey("request_id")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -35,3 +69,124 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method retrieves the plaintext authentication token from the
+// request context. Unlike contextGetUser(), it returns the empty string if there isn't
+// one, as anonymous requests are not made with a token.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetClaims() method returns a new copy of the request with the claims of a
+// signed token added to the context.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClaims() method retrieves the claims of a signed token from the request
+// context, or nil if the request wasn't authenticated with a signed token.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the
+// permissions granted at authentication time added to the context.
+func (app *application) contextSetPermissions(
+	r *http.Request,
+	permissions data.Permissions,
+) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() method retrieves the permissions granted at
+// authentication time from the request context. The second return value is false if
+// none were set, in which case the permissions should be looked up in the database.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the ID of the
+// API key that it was authenticated with added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, keyID int64) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, keyID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() method retrieves the ID of the API key that the request was
+// authenticated with from the request context. It returns 0 if the request wasn't made
+// with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) int64 {
+	keyID, _ := r.Context().Value(apiKeyContextKey).(int64)
+	return keyID
+}
+
+// The contextSetOAuthClient() method returns a new copy of the request with the ID of
+// the OAuth client that its token was issued to added to the context.
+func (app *application) contextSetOAuthClient(r *http.Request, clientID int64) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthClientContextKey, clientID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetOAuthClient() method retrieves the ID of the OAuth client that the
+// request's token was issued to from the request context. It returns 0 if the request
+// wasn't made with a token issued to an OAuth client.
+func (app *application) contextGetOAuthClient(r *http.Request) int64 {
+	clientID, _ := r.Context().Value(oauthClientContextKey).(int64)
+	return clientID
+}
+
+// The contextSetImpersonator() method returns a new copy of the request with the ID of
+// the impersonating administrator added to the context.
+func (app *application) contextSetImpersonator(r *http.Request, adminID int64) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonatorContextKey, adminID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetImpersonator() method retrieves the ID of the impersonating
+// administrator from the request context. It returns 0 if the request isn't being made
+// by an administrator impersonating the user.
+func (app *application) contextGetImpersonator(r *http.Request) int64 {
+	adminID, _ := r.Context().Value(impersonatorContextKey).(int64)
+	return adminID
+}
+
+// The contextSetOrganization() method returns a new copy of the request with the ID of
+// the organization that it acts in added to the context.
+func (app *application) contextSetOrganization(r *http.Request, orgID int64) *http.Request {
+	ctx := context.WithValue(r.Context(), organizationContextKey, orgID)
+	return r.WithContext(ctx)
+}
+
+// The contextGetOrganization() method retrieves the ID of the organization that the
+// request acts in from the request context. It returns 0 if the request is anonymous,
+// or the user doesn't belong to any organization.
+func (app *application) contextGetOrganization(r *http.Request) int64 {
+	orgID, _ := r.Context().Value(organizationContextKey).(int64)
+	return orgID
+}
+
+// The contextSetRequestID() method returns a new copy of the request with its ID added
+// to the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method retrieves the request's ID from the request context.
+// It returns the empty string if the request hasn't been given one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
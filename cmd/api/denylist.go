@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/jwt"
+)
+
+// The denylist type is an in-memory copy of the token denylist tables, which lets us
+// reject revoked signed tokens without querying the database on every request.
+type denylist struct {
+	mu       sync.RWMutex
+	entries  map[string]time.Time
+	families map[string]time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{
+		entries:  make(map[string]time.Time),
+		families: make(map[string]time.Time),
+	}
+}
+
+// Add() adds a token ID to the in-memory denylist.
+func (d *denylist) Add(jti string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries[jti] = expiry
+}
+
+// AddFamily() adds a token family to the in-memory denylist.
+func (d *denylist) AddFamily(family string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.families[family] = expiry
+}
+
+// Contains() reports whether a signed token has been revoked, either by itself or
+// along with the rest of its family.
+func (d *denylist) Contains(claims *jwt.Claims) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, found := d.entries[claims.ID]; found {
+		return true
+	}
+
+	_, found := d.families[claims.Family]
+	return found && claims.Family != ""
+}
+
+// Replace() swaps the in-memory denylist for a fresh copy loaded from the database.
+func (d *denylist) Replace(entries, families map[string]time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries = entries
+	d.families = families
+}
+
+// The revokeSignedToken() helper revokes a signed token before its expiry, by adding
+// its ID to the denylist table and to this instance's in-memory denylist. Other
+// instances will pick up the change the next time they sync.
+func (app *application) revokeSignedToken(claims *jwt.Claims) error {
+	err := app.models.Denylist.Insert(claims.ID, claims.ExpiresAt())
+	if err != nil {
+		return err
+	}
+
+	app.denylist.Add(claims.ID, claims.ExpiresAt())
+
+	return nil
+}
+
+// The revokeTokenFamilies() helper revokes every signed token issued in the given
+// token families, by adding the families to the denylist until the last of those
+// tokens would have expired. It should be called whenever sessions are deleted, since
+// deleting a session's tokens from the database doesn't affect its signed tokens. If
+// signed tokens aren't in use, it does nothing.
+//
+// The families are added to this instance's in-memory denylist straight away, even if
+// the models' transaction is later rolled back. That only means the session's signed
+// tokens are rejected a little early, until the next sync.
+func (app *application) revokeTokenFamilies(models data.Models, families []string) error {
+	if app.denylist == nil {
+		return nil
+	}
+
+	expiry := time.Now().Add(app.config.auth.accessTokenTTL)
+
+	for _, family := range families {
+		if family == "" {
+			continue
+		}
+
+		err := models.Denylist.InsertFamily(family, expiry)
+		if err != nil {
+			return err
+		}
+
+		app.denylist.AddFamily(family, expiry)
+	}
+
+	return nil
+}
+
+// The loadDenylist() helper refreshes the in-memory denylist from the database,
+// removing expired entries from the table as it goes.
+func (app *application) loadDenylist() error {
+	err := app.models.Denylist.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	entries, err := app.models.Denylist.GetAll()
+	if err != nil {
+		return err
+	}
+
+	families, err := app.models.Denylist.GetAllFamilies()
+	if err != nil {
+		return err
+	}
+
+	app.denylist.Replace(entries, families)
+
+	return nil
+}
+
+// The syncDenylist() helper launches a background goroutine which reloads the
+// denylist at the given interval, so that tokens revoked through another instance are
+// rejected here too.
+func (app *application) syncDenylist(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			err := app.loadDenylist()
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+	}()
+}
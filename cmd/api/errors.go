@@ -2,18 +2,24 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/ratelimit"
 )
 
 // The logError() method is a helper for logging an error message, along
 // with the current request method and URL as attributes in the log entry.
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = r.URL.RequestURI()
+		requestID = app.contextGetRequestID(r)
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestID)
 }
 
 // The errorResponse() method is a helper for sending JSON-formatted error
@@ -80,11 +86,29 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+// The rateLimitExceededResponse() method sends a 429 Too Many Requests response, with
+// headers describing the limit and how long the client should wait before retrying.
+func (app *application) rateLimitExceededResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	result ratelimit.Result,
+) {
+	setRateLimitHeaders(w, result)
+	w.Header().Set("Retry-After", retryAfterSeconds(time.Now().Add(result.RetryAfter)))
+
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// The passwordHashBusyResponse() method sends a 503 Service Unavailable response when
+// a password can't be checked or hashed because too many are already being hashed.
+func (app *application) passwordHashBusyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+
+	message := "the server is busy, please try again shortly"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -97,6 +121,11 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -107,7 +136,89 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) delegatedCredentialNotPermittedResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	message := "this action can't be performed with an API key or OAuth token, please log in"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) deactivatedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been deactivated"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must enable two-factor authentication to perform this action"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) impersonationNotPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this action can't be performed while impersonating a user"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) organizationNotPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you are not a member of this organization, or your token can't be used with it"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// The oauthErrorResponse() method sends an error response in the format required by
+// the OAuth 2.0 specification (RFC 6749 section 5.2), which clients of the token and
+// revocation endpoints expect, rather than our usual format.
+func (app *application) oauthErrorResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	status int,
+	code, description string,
+) {
+	env := envelope{"error": code, "error_description": description}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="greenlight"`)
+	}
+
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+func (app *application) loginThrottledResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	retryAfter time.Time,
+) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) accountLockedResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	retryAfter time.Time,
+) {
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+
+	message := "your account has been temporarily locked because of too many failed login attempts"
+	app.errorResponse(w, r, http.StatusLocked, message)
+}
+
+// The retryAfterSeconds() helper formats the time remaining until t as a number of
+// seconds, for use in a Retry-After header. It is always at least 1.
+func retryAfterSeconds(t time.Time) string {
+	seconds := max(1, int(math.Ceil(time.Until(t).Seconds())))
+	return strconv.Itoa(seconds)
+}
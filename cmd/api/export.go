@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The createDataExportHandler() starts exporting all of the personal data that we hold
+// about the authenticated user, to answer a data subject access request. The export is
+// prepared in the background, and the user is emailed a link to download it once it's
+// ready.
+func (app *application) createDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Preparing an export is expensive and sends an email, so limit how often it can
+	// be done.
+	if result := app.emailThrottle.Allow("export:" + user.Email); !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result)
+		return
+	}
+
+	app.background(func() {
+		err := app.exportUserData(r, user)
+		if err != nil {
+			app.logger.Error(err.Error(), "user_id", user.ID)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing a link to download your data"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showDataExportHandler() sends a personal data export as a ZIP file. The export
+// is identified by the single-use-per-export token included in the download link, so
+// that the link can be opened in a browser without an authentication token.
+func (app *application) showDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	token := httprouter.ParamsFromContext(r.Context()).ByName("token")
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err := app.models.Users.GetForToken(data.ScopeDataExport, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	file, err := os.Open(app.exportPath(token))
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="greenlight-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// The exportUserData() helper gathers everything that we hold about a user into a ZIP
+// file of JSON documents, stores it in the export directory, and emails the user a link
+// to download it. Secrets (such as password hashes, token hashes and TOTP secrets) are
+// not included. The download token is recorded in the audit log against the request
+// that asked for the export.
+func (app *application) exportUserData(r *http.Request, user *data.User) error {
+	orgs, err := app.models.Organizations.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	// Permissions and attributes are held within an organization, so list them for
+	// each one that the user belongs to.
+	memberships := []map[string]any{}
+
+	for _, org := range orgs {
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID, org.ID)
+		if err != nil {
+			return err
+		}
+
+		if permissions == nil {
+			permissions = data.Permissions{}
+		}
+
+		// The user may have left the organization since it was listed.
+		attributes, err := app.models.Organizations.GetMemberAttributes(org.ID, user.ID)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+
+		memberships = append(memberships, map[string]any{
+			"organization": org,
+			"permissions":  permissions,
+			"attributes":   attributes,
+		})
+	}
+
+	sessions, err := app.models.Tokens.GetAllSessionsForUser(user.ID, "")
+	if err != nil {
+		return err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	oauthClients, err := app.models.OAuthClients.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	mfaEnabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		return err
+	}
+
+	movies, err := app.models.Movies.GetAllCreatedBy(user.ID)
+	if err != nil {
+		return err
+	}
+
+	auditEvents, err := app.models.Audit.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	impersonations, err := app.models.Impersonations.GetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]any{
+		"profile.json":        user,
+		"organizations.json":  memberships,
+		"sessions.json":       sessions,
+		"api_keys.json":       apiKeys,
+		"oauth_clients.json":  oauthClients,
+		"two_factor.json":     map[string]bool{"enabled": mfaEnabled},
+		"movies.json":         movies,
+		"audit_events.json":   auditEvents,
+		"impersonations.json": impersonations,
+	}
+
+	var token *data.Token
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		var err error
+
+		token, err = tx.Tokens.New(user.ID, app.config.export.ttl, data.ScopeDataExport)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeExport(app.exportPath(token.Plaintext), files)
+	if err != nil {
+		return err
+	}
+
+	emailData := map[string]any{
+		"downloadURL": strings.TrimRight(app.config.baseURL, "/") + "/v1/exports/" + token.Plaintext,
+		"expiry":      token.Expiry.UTC().Format(time.RFC1123),
+	}
+
+	return app.mailer.Send(user.Email, "data_export.tmpl", emailData)
+}
+
+// The writeExport() function writes a ZIP file containing each value in files, encoded
+// as JSON, to path. The file is written under a temporary name and then renamed, so
+// that a partially written export is never served.
+func writeExport(path string, files map[string]any) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "export-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	zw := zip.NewWriter(tmp)
+
+	for name, value := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		js, err := json.MarshalIndent(value, "", "\t")
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		_, err = fw.Write(append(js, '\n'))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// The exportPath() helper returns the path of the export file for a download token.
+// Files are named after the token's hash, so the plaintext token can't be recovered
+// from the export directory.
+func (app *application) exportPath(tokenPlaintext string) string {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return filepath.Join(app.config.export.dir, hex.EncodeToString(hash[:])+".zip")
+}
+
+// The cleanupExports() helper launches a background goroutine which periodically
+// deletes export files (and any leftover temporary files) that are older than the
+// export TTL, and so can no longer be downloaded.
+func (app *application) cleanupExports(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			entries, err := os.ReadDir(app.config.export.dir)
+			if err != nil {
+				app.logger.Error(err.Error())
+				continue
+			}
+
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil || time.Since(info.ModTime()) < app.config.export.ttl {
+					continue
+				}
+
+				err = os.Remove(filepath.Join(app.config.export.dir, entry.Name()))
+				if err != nil {
+					app.logger.Error(err.Error())
+				}
+			}
+		}
+	}()
+}
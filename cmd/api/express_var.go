@@ -26,3 +26,10 @@ func publishMetrics(db *sql.DB) {
 		return time.Now().Unix()
 	}))
 }
+
+// Publish the permission cache's hit ratio and size.
+func publishPermissionCacheMetrics(cache *permissionCache) {
+	expvar.Publish("permission_cache", expvar.Func(func() any {
+		return cache.Stats()
+	}))
+}
@@ -10,9 +10,13 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/password"
 	"github.com/chlovec/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
+	"github.com/tomasen/realip"
 )
 
 type envelope map[string]any
@@ -183,6 +187,160 @@ func (app *application) readInt(
 	return i
 }
 
+// The readTime() helper reads an RFC 3339 timestamp from the query string. If no
+// matching key could be found it returns the zero time, and if the value couldn't be
+// parsed, it records an error message in the provided Validator instance.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+
+	return t
+}
+
+// The checkCurrentPassword() helper loads the full record for the authenticated user
+// (the user in the request context may only be partially populated, for example if the
+// request used a stateless token) and checks that the password provided matches it.
+// If the password is missing or doesn't match, an error is recorded in the validator
+// against the given key.
+//
+// Wrong passwords count as failed logins, so that somebody who gets hold of an access
+// token can't use this to guess the user's password any faster than by logging in. If
+// password checks are currently blocked for the client's IP address or the account, or
+// something goes wrong, a response is sent and false is returned.
+func (app *application) checkCurrentPassword(
+	w http.ResponseWriter,
+	r *http.Request,
+	v *validator.Validator,
+	key string,
+	plaintext string,
+) (*data.User, bool) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if plaintext == "" {
+		v.AddError(key, "must be provided")
+		return user, true
+	}
+
+	if !app.loginAllowed(w, r, data.LoginFailureIP, realip.FromRequest(r)) ||
+		!app.loginAllowed(w, r, data.LoginFailureAccount, strconv.FormatInt(user.ID, 10)) {
+		return nil, false
+	}
+
+	match, err := user.Password.Matches(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPasswordHashBusy):
+			app.passwordHashBusyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
+
+		v.AddError(key, "is incorrect")
+		return user, true
+	}
+
+	err = app.models.LoginFailures.Reset(data.LoginFailureAccount, strconv.FormatInt(user.ID, 10))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// The validateNewPassword() helper checks a password that a user has chosen, recording
+// an error in the validator if it is too weak or has appeared in a data breach. The
+// userInputs (such as the user's name and email address) are treated as easy to guess.
+func (app *application) validateNewPassword(
+	v *validator.Validator,
+	plaintext string,
+	userInputs ...string,
+) error {
+	data.ValidatePasswordPlaintext(v, plaintext)
+
+	if _, exists := v.Errors["password"]; exists {
+		return nil
+	}
+
+	result := password.Estimate(plaintext, userInputs...)
+	if result.Score < app.config.password.minStrength {
+		v.AddError("password", result.Warning)
+		return nil
+	}
+
+	if app.breached != nil {
+		breached, err := app.breached.Contains(plaintext)
+		if err != nil {
+			return err
+		}
+
+		v.Check(!breached, "password", "must not be a password that has appeared in a data breach")
+	}
+
+	return nil
+}
+
+// The requestPermissions() helper returns the permissions that the current request has.
+// If the request was authenticated with a token that carries its own permissions (or is
+// restricted to a subset of the user's permissions), we use those. Otherwise we look up
+// the user's permissions, using the permission cache if it is enabled.
+func (app *application) requestPermissions(r *http.Request) (data.Permissions, error) {
+	permissions, ok := app.contextGetPermissions(r)
+	if ok {
+		return permissions, nil
+	}
+
+	return app.userPermissions(app.contextGetUser(r).ID, app.contextGetOrganization(r))
+}
+
+// The validateHeldPermissions() helper checks that every permission code in codes is
+// held by the current request, recording a validation error against the given key if
+// not. This stops a restricted credential from being used to create another one with
+// more permissions than it has itself.
+func (app *application) validateHeldPermissions(
+	v *validator.Validator,
+	r *http.Request,
+	key string,
+	codes data.Permissions,
+) error {
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		v.Check(
+			permissions.Include(code),
+			key,
+			fmt.Sprintf("must only contain permissions that you hold (%q is not one)", code),
+		)
+	}
+
+	return nil
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// Invitations stay valid for a week, to give the invitee time to act on them.
+const invitationTTL = 7 * 24 * time.Hour
+
+// The listInvitationsHandler() shows an administrator every invitation to their
+// organization that has been sent, along with whether it has been accepted.
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.models.Invitations.GetAll(app.contextGetOrganization(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createInvitationHandler() lets an administrator invite somebody to create an
+// account in their organization, with a chosen set of permissions there. The
+// invitation token is emailed to the invitee, and isn't included in the response.
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string           `json:"email"`
+		Permissions data.Permissions `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	invitation := &data.Invitation{
+		Email:       input.Email,
+		Permissions: input.Permissions,
+		InvitedBy:   app.contextGetUser(r).ID,
+		OrgID:       app.contextGetOrganization(r),
+		Expiry:      time.Now().Add(invitationTTL),
+	}
+
+	v := validator.New()
+
+	data.ValidateInvitation(v, invitation)
+
+	// Administrators can only grant permissions that they hold themselves.
+	err = app.validateHeldPermissions(v, r, "permissions", invitation.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Don't let invitations be used to flood somebody's inbox.
+	if result := app.emailThrottle.Allow("invitation:" + invitation.Email); !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result)
+		return
+	}
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Invitations.Insert(invitation)
+		if err != nil {
+			return err
+		}
+
+		return log.record("invitation.create", "invitation", invitation.ID, nil, invitation)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"invitationToken": invitation.Plaintext,
+			"expiry":          invitation.Expiry.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(invitation.Email, "user_invitation.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteInvitationHandler() revokes an invitation which hasn't been accepted yet.
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		invitation, err := tx.Invitations.DeletePending(app.contextGetOrganization(r), id)
+		if err != nil {
+			return err
+		}
+
+		return log.record("invitation.delete", "invitation", invitation.ID, invitation, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invitation successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The acceptInvitationHandler() creates an account for somebody who has been invited.
+// The account is activated straight away, as the invitation token proves that they can
+// read email sent to the address, and has exactly the permissions in the invitation.
+func (app *application) acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Name           string `json:"name"`
+		Password       string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	invitation, err := app.models.Invitations.GetPendingForToken(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := &data.User{
+		Name:      input.Name,
+		Email:     invitation.Email,
+		Activated: true,
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPasswordHashBusy):
+			app.passwordHashBusyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data.ValidateUser(v, user)
+
+	err = app.validateNewPassword(v, input.Password, input.Name, invitation.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Email addresses are unique, so if the same invitation is accepted twice at once,
+	// only one of the requests will be able to create the user.
+	// The user is created, given the invitation's permissions and the invitation is
+	// marked as accepted in one transaction, along with the audit events.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		log.setActor(user.ID)
+		log.setOrganization(invitation.OrgID)
+
+		err = tx.Organizations.AddMember(invitation.OrgID, user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Permissions.AddForUser(user.ID, invitation.OrgID, invitation.Permissions...)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Invitations.MarkAccepted(invitation)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("user.create", "user", user.ID, nil, user)
+		if err != nil {
+			return err
+		}
+
+		return log.record(
+			"permission.grant",
+			"user",
+			user.ID,
+			nil,
+			permissionsAudit(invitation.OrgID, invitation.Permissions...),
+		)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
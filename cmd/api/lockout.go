@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/tomasen/realip"
+)
+
+const (
+	// Failed login attempts are only counted if they happen within this window of the
+	// previous failure.
+	loginFailureWindow = 24 * time.Hour
+
+	// Once the free attempts are used up, each further failure blocks logins for twice
+	// as long as the one before, starting from loginBackoffBase and up to a maximum of
+	// loginBackoffMax.
+	loginBackoffBase = time.Second
+	loginBackoffMax  = 15 * time.Minute
+)
+
+// A loginPolicy describes how we respond to repeated failed logins for one kind of
+// subject. A lockoutThreshold of 0 means the subject is never locked out completely,
+// although exponential backoff still applies.
+type loginPolicy struct {
+	freeAttempts     int
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+}
+
+// The delay() method returns how long logins should be blocked for after the given
+// number of consecutive failures.
+func (p loginPolicy) delay(failures int) time.Duration {
+	if p.lockoutThreshold > 0 && failures >= p.lockoutThreshold {
+		return p.lockoutDuration
+	}
+
+	if failures <= p.freeAttempts {
+		return 0
+	}
+
+	// Limit the exponent so that the shift can't overflow.
+	exponent := min(failures-p.freeAttempts-1, 20)
+
+	return min(loginBackoffBase<<exponent, loginBackoffMax)
+}
+
+// The loginPolicy() method returns the policy for a kind of subject. Many users may
+// share an IP address (for example, behind a corporate NAT), so IP addresses get more
+// free attempts than accounts, and are never locked out.
+func (app *application) loginPolicy(kind string) loginPolicy {
+	if kind == data.LoginFailureAccount {
+		return loginPolicy{
+			freeAttempts:     3,
+			lockoutThreshold: app.config.auth.lockoutThreshold,
+			lockoutDuration:  app.config.auth.lockoutDuration,
+		}
+	}
+
+	return loginPolicy{freeAttempts: 20}
+}
+
+// The loginAllowed() helper checks whether logins for a subject are currently blocked.
+// If they are, it sends a 423 Locked response (for a locked account) or a 429 Too Many
+// Requests response (while backing off), with a Retry-After header, and returns false.
+func (app *application) loginAllowed(
+	w http.ResponseWriter,
+	r *http.Request,
+	kind, subject string,
+) bool {
+	failure, err := app.models.LoginFailures.GetLocked(kind, subject)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return true
+		default:
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	policy := app.loginPolicy(kind)
+
+	if policy.lockoutThreshold > 0 && failure.Failures >= policy.lockoutThreshold {
+		app.accountLockedResponse(w, r, *failure.LockedUntil)
+	} else {
+		app.loginThrottledResponse(w, r, *failure.LockedUntil)
+	}
+
+	return false
+}
+
+// The recordFailedLogin() helper records a failed login attempt from the client's IP
+// address and, if the email address belongs to a user, against their account too. It
+// blocks further attempts according to the login policies, and emails the user when
+// their account gets locked.
+func (app *application) recordFailedLogin(r *http.Request, user *data.User) error {
+	ip := realip.FromRequest(r)
+
+	_, err := app.recordLoginFailure(data.LoginFailureIP, ip)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	failure, err := app.recordLoginFailure(
+		data.LoginFailureAccount,
+		strconv.FormatInt(user.ID, 10),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Only send the email once, when the account first becomes locked.
+	if failure.Failures != app.config.auth.lockoutThreshold {
+		return nil
+	}
+
+	app.logger.Warn("account locked after failed login attempts", "user_id", user.ID, "ip", ip)
+
+	app.background(func() {
+		data := map[string]any{
+			"lockedUntil": failure.LockedUntil.UTC().Format(time.RFC1123),
+			"ip":          ip,
+		}
+
+		err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	return nil
+}
+
+// The recordLoginFailure() helper records a single failure for a subject and, if the
+// policy calls for it, locks the subject.
+func (app *application) recordLoginFailure(kind, subject string) (*data.LoginFailure, error) {
+	failure, err := app.models.LoginFailures.Record(kind, subject, loginFailureWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := app.loginPolicy(kind).delay(failure.Failures)
+	if delay == 0 {
+		return failure, nil
+	}
+
+	lockedUntil := time.Now().Add(delay)
+
+	err = app.models.LoginFailures.Lock(kind, subject, lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	failure.LockedUntil = &lockedUntil
+
+	return failure, nil
+}
+
+// The deleteUserLockoutHandler() lets an administrator unlock an account which has been
+// locked because of failed login attempts.
+func (app *application) deleteUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readManagedUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	subject := strconv.FormatInt(user.ID, 10)
+
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		var before any
+
+		failure, err := tx.LoginFailures.GetLocked(data.LoginFailureAccount, subject)
+		switch {
+		case err == nil:
+			before = map[string]any{"failures": failure.Failures, "locked_until": failure.LockedUntil}
+		case !errors.Is(err, data.ErrRecordNotFound):
+			return err
+		}
+
+		err = tx.LoginFailures.Reset(data.LoginFailureAccount, subject)
+		if err != nil {
+			return err
+		}
+
+		return log.record("user.unlock", "user", user.ID, before, nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "account successfully unlocked"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// Magic links are only valid for a short time, as anybody who can read the email can
+// use them to log in.
+const magicLinkTTL = 15 * time.Minute
+
+// The createMagicLinkTokenHandler() emails a single-use magic-login token to a user, so
+// that they can log in without a password.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Throttle requests per email address before doing anything else, so that this
+	// endpoint can't be used to flood somebody's inbox.
+	if result := app.emailThrottle.Allow("magic_link:" + input.Email); !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result)
+		return
+	}
+
+	// We send the same response whether or not a magic link was sent, so that this
+	// endpoint can't be used to find out which email addresses have accounts.
+	env := envelope{"message": "if the email address belongs to an activated account, an email will be sent to it containing login instructions"}
+
+	// Only activated users can log in with a magic link. Users who haven't activated
+	// their account yet should use their activation token instead, and deactivated
+	// users can't log in at all.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err == nil && user.Activated && !user.Deactivated {
+		// Delete any existing magic-login tokens for the user, so that only the token
+		// in the latest email can be used.
+		var token *data.Token
+
+		err = app.audit(r, func(tx data.Models, log *auditLog) error {
+			log.setActor(user.ID)
+
+			err := tx.Tokens.DeleteAllForUser(data.ScopeMagicLogin, user.ID)
+			if err != nil {
+				return err
+			}
+
+			token, err = tx.Tokens.New(user.ID, magicLinkTTL, data.ScopeMagicLogin)
+			if err != nil {
+				return err
+			}
+
+			return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]any{
+				"magicToken": token.Plaintext,
+				"expiry":     token.Expiry.UTC().Format(time.RFC1123),
+			}
+
+			err := app.mailer.Send(user.Email, "magic_login.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The exchangeMagicLinkTokenHandler() exchanges a magic-login token for an
+// authentication token, in the same way as logging in with a password. Each magic-login
+// token can only be used once.
+func (app *application) exchangeMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Mark the token as used, so that it can't be exchanged again (even by a
+	// concurrent request).
+	token, err := app.models.Tokens.Consume(data.ScopeMagicLogin, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired magic-login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired magic-login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Delete the used token along with any other outstanding magic links.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		log.setActor(user.ID)
+
+		err := tx.Tokens.DeleteAllForUser(data.ScopeMagicLogin, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, scopeAudit(data.ScopeMagicLogin), nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
@@ -5,12 +5,18 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/jwt"
 	"github.com/chlovec/greenlight/internal/mailer"
+	"github.com/chlovec/greenlight/internal/password"
+	"github.com/chlovec/greenlight/internal/policy"
+	"github.com/chlovec/greenlight/internal/ratelimit"
+	"github.com/chlovec/greenlight/internal/totp"
 	"github.com/chlovec/greenlight/internal/vcs"
 	_ "github.com/lib/pq"
 )
@@ -19,11 +25,21 @@ import (
 var version = vcs.Version()
 
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer *mailer.Mailer
-	wg     sync.WaitGroup
+	config          config
+	logger          *slog.Logger
+	models          data.Models
+	mailer          *mailer.Mailer
+	emailThrottle   *throttle
+	mfaThrottle     *throttle
+	signingKeys     *jwt.KeySet
+	totpKeys        *totp.KeyRing
+	denylist        *denylist
+	breached        *password.Breached
+	permissionCache *permissionCache
+	policy          *policy.Engine
+	limiter         ratelimit.Store
+	rateLimits      *rateLimitPolicy
+	wg              sync.WaitGroup
 }
 
 func main() {
@@ -37,6 +53,26 @@ func main() {
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	// Use the configured argon2id parameters to hash new passwords. Argon2 needs at
+	// least one iteration and lane, and at least 8 KiB of memory per lane.
+	if cfg.password.iterations < 1 ||
+		cfg.password.parallelism < 1 || cfg.password.parallelism > 255 ||
+		cfg.password.memory < 8*cfg.password.parallelism || cfg.password.memory > math.MaxUint32 {
+		logger.Error("invalid argon2id password hashing parameters")
+		os.Exit(1)
+	}
+
+	data.PasswordHashParams.Memory = uint32(cfg.password.memory)
+	data.PasswordHashParams.Iterations = uint32(cfg.password.iterations)
+	data.PasswordHashParams.Parallelism = uint8(cfg.password.parallelism)
+
+	if cfg.password.maxConcurrent < 1 {
+		logger.Error("password-max-concurrent must be at least 1")
+		os.Exit(1)
+	}
+
+	data.SetPasswordHashConcurrency(cfg.password.maxConcurrent)
+
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct as an argument. If this returns an error, we log
 	// it and exit the application immediately.
@@ -78,6 +114,118 @@ func main() {
 		mailer: mailer,
 	}
 
+	// If any token signing keys are configured, load them so that we can verify signed
+	// tokens (and issue them, in stateless mode), and keep the revoked token denylist
+	// up to date.
+	if len(cfg.auth.signingKeys) > 0 {
+		app.signingKeys, err = jwt.ParseKeySet(cfg.auth.signingKeys)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		app.denylist = newDenylist()
+
+		err = app.loadDenylist()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		app.syncDenylist(cfg.auth.denylistInterval)
+	} else if cfg.auth.stateless {
+		logger.Error("stateless authentication requires at least one signing key")
+		os.Exit(1)
+	}
+
+	// Load the keys that two-factor authentication secrets are encrypted with.
+	app.totpKeys, err = totp.ParseKeyRing(cfg.auth.totpKeys)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Cache users' permissions, and keep the cache up to date with changes made
+	// through any instance.
+	if cfg.auth.permissionCacheTTL > 0 {
+		app.permissionCache = newPermissionCache(cfg.auth.permissionCacheTTL)
+
+		err = app.listenForPermissionChanges(cfg.db.dsn)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		publishPermissionCacheMetrics(app.permissionCache)
+	}
+
+	// Set up the store which holds the state of the rate limiter and throttles, and the
+	// policy which decides which limit applies to each request. The throttles are
+	// needed even if requests aren't rate limited.
+	app.limiter, err = newLimiterStore(cfg, db)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	logger.Info("rate limiter store ready", "store", cfg.limiter.store)
+
+	if cfg.limiter.enabled {
+		app.rateLimits, err = newRateLimitPolicy(cfg)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Limit how often we send emails to any single address, so that endpoints which
+	// send email on request can't be used to spam people. Each kind of email is keyed
+	// separately (as "<purpose>:<email>"), so that requesting one kind for somebody
+	// else's address doesn't use up their allowance for others.
+	app.emailThrottle = newThrottle(
+		app.limiter,
+		logger,
+		"throttle:email:",
+		cfg.limiter.emailInterval,
+		cfg.limiter.emailBurst,
+	)
+
+	// Limit guesses at two-factor authentication codes to a handful per user.
+	app.mfaThrottle = newThrottle(app.limiter, logger, "throttle:mfa:", time.Minute, 5)
+
+	// Load the authorization policy.
+	app.policy, err = policy.LoadFile(cfg.policyFile)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Make sure that the directory for personal data exports exists, and start
+	// removing old exports from it.
+	err = os.MkdirAll(cfg.export.dir, 0o700)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	app.cleanupExports(time.Hour)
+
+	// Start removing audit events which are older than the retention period.
+	app.cleanupAuditLog(time.Hour)
+
+	// If a breached password corpus is configured, open it so that new passwords can
+	// be checked against it.
+	if cfg.password.breachedFile != "" {
+		app.breached, err = password.OpenBreached(cfg.password.breachedFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer app.breached.Close()
+
+		logger.Info("breached password corpus opened", "hashes", app.breached.Count())
+	}
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -85,6 +233,31 @@ func main() {
 	}
 }
 
+// The newLimiterStore() function returns the rate limiter store chosen in the
+// configuration.
+func newLimiterStore(cfg config, db *sql.DB) (ratelimit.Store, error) {
+	switch cfg.limiter.store {
+	case "memory":
+		return ratelimit.NewMemoryStore(), nil
+	case "postgres":
+		return ratelimit.NewPostgresStore(db, time.Minute), nil
+	case "redis":
+		store := ratelimit.NewRESPStore(cfg.limiter.redisAddr, cfg.limiter.redisPassword, cfg.db.maxIdleConns)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := store.Ping(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("rate limiter store: %w", err)
+		}
+
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter store %q", cfg.limiter.store)
+	}
+}
+
 // The openDB() function returns a sql.DB connection pool.
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config
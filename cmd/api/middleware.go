@@ -1,19 +1,20 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
 	"expvar"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/jwt"
 	"github.com/chlovec/greenlight/internal/validator"
 	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
 type metricsResponseWriter struct {
@@ -102,6 +103,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
 
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
@@ -113,7 +115,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 						w.Header().
 							Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
 						w.Header().
-							Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+							Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Organization-ID, X-Request-ID")
 
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
@@ -130,6 +132,32 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// The exposedHeaders are the response headers which browsers let cross-origin scripts
+// read.
+const exposedHeaders = "X-Request-ID, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After"
+
+// Clients and proxies can send the ID that they use for a request in this header, so
+// that it can be matched with our logs and audit events. If they don't, or the ID
+// isn't usable, a new one is generated. Either way, it's echoed in the response.
+const requestIDHeader = "X-Request-ID"
+
+// The requestIDRX regular expression matches the request IDs that we accept from
+// clients: up to 64 letters, digits, hyphens, underscores and dots.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRX.MatchString(id) {
+			id = rand.Text()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function (which will always be run in the event
@@ -158,66 +186,51 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// The rateLimit() middleware limits requests per IP address, before they are
+// authenticated, so that guessing credentials is throttled along with everything
+// else. It must come before authenticate().
 func (app *application) rateLimit(next http.Handler) http.Handler {
+	return app.limitRequests(next, false)
+}
+
+// The rateLimitIdentity() middleware limits authenticated requests per user or API
+// key. It must come after authenticate().
+func (app *application) rateLimitIdentity(next http.Handler) http.Handler {
+	return app.limitRequests(next, true)
+}
+
+// The limitRequests() helper returns middleware which counts each request against the
+// limit which applies to it in the given pass, and refuses it if the limit has been
+// reached. See the rateLimitPolicy type for how each request's limit is chosen.
+func (app *application) limitRequests(next http.Handler, authenticated bool) http.Handler {
 	// If rate limiting is not enabled, return the next handler in the chain with
 	// with no further action.
 	if !app.config.limiter.enabled {
 		return next
 	}
 
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			mu.Lock()
-
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-
-			mu.Unlock()
-		}
-	}()
-
-	// The function we are returning is a closure, which 'closes over' the limiter
-	// variable.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := realip.FromRequest(r)
-
-		mu.Lock()
-
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{
-				// Use the requests-per-second and burst values from the config
-				// struct.
-				limiter: rate.NewLimiter(
-					rate.Limit(app.config.limiter.rps),
-					app.config.limiter.burst,
-				),
-			}
+		key, limit, limited := app.limitFor(r, authenticated)
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		clients[ip].lastSeen = time.Now()
+		result, err := app.limiter.Allow(r.Context(), key, limit)
+		if err != nil {
+			// If the limiter's store can't be reached, let the request through
+			// rather than taking the whole API down with it.
+			app.logError(r, fmt.Errorf("rate limiter unavailable: %w", err))
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		if !clients[ip].limiter.Allow() {
-			mu.Unlock()
-			app.rateLimitExceededResponse(w, r)
+		if !result.Allowed {
+			app.rateLimitExceededResponse(w, r, result)
 			return
 		}
 
-		mu.Unlock()
+		setRateLimitHeaders(w, result)
 
 		next.ServeHTTP(w, r)
 	})
@@ -229,6 +242,15 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// caches that the response may vary based on the value of the Authorization
 		// header in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+		w.Header().Add("Vary", organizationHeader)
+
+		// Machine clients can authenticate with an API key in the X-API-Key header
+		// instead of an authentication token.
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			app.authenticateAPIKey(w, r, next, apiKey)
+			return
+		}
 
 		// Retrieve the value of the Authorization header from the request. This will
 		// return the empty string "" if there is no such header found.
@@ -250,6 +272,22 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// using the invalidAuthenticationTokenResponse() helper (which we will create
 		// in a moment).
 		headerParts := strings.Split(authorizationHeader, " ")
+
+		// API keys may also be sent in the Authorization header, as "ApiKey <key>".
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
+		// HTTP Basic credentials are used by OAuth clients to authenticate themselves
+		// to the token endpoint, not to identify a user, so we treat the request as
+		// anonymous and leave it to the handler to check them.
+		if len(headerParts) == 2 && headerParts[0] == "Basic" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -258,6 +296,24 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
+		// If the token is a JWT and we have signing keys configured, it's a stateless
+		// token which we can verify without touching the database.
+		if app.signingKeys != nil && jwt.LooksLikeJWT(token) {
+			r, ok := app.authenticateSignedToken(r, token)
+			if !ok {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r, ok = app.selectOrganization(w, r, app.contextGetUser(r).ID)
+			if !ok {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -271,9 +327,9 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// Retrieve the details of the user associated with the authentication token,
 		// again calling the invalidAuthenticationTokenResponse() helper if no
-		// matching record was found. IMPORTANT: Notice that we are using
-		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		// matching record was found. If the token was issued to an OAuth client, this
+		// also returns the permissions that the user granted to the client.
+		user, authToken, err := app.models.Users.GetForAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -284,15 +340,142 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Record when and where the token was last used, so that the user can review
+		// their active sessions.
+		err = app.models.Tokens.Touch(token, r.UserAgent(), realip.FromRequest(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		// Call the contextSetUser() helper to add the user information to the request
-		// context.
+		// context, and the contextSetToken() helper to add the token itself.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+
+		// Work out which organization the request acts in.
+		r, ok := app.selectOrganization(w, r, user.ID)
+		if !ok {
+			return
+		}
+
+		if authToken.ClientID != 0 {
+			r = app.contextSetOAuthClient(r, authToken.ClientID)
+		}
+
+		// Like API keys, tokens issued to an OAuth client are limited to the granted
+		// permissions which the user still holds.
+		if authToken.Permissions != nil {
+			permissions, err := app.userPermissions(user.ID, app.contextGetOrganization(r))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			r = app.contextSetPermissions(r, authToken.Permissions.Intersect(permissions))
+		}
+
+		// If an administrator is impersonating the user, note that in the context and
+		// log every request they make, so that their actions can be audited.
+		if authToken.ImpersonatorID != 0 {
+			r = app.contextSetImpersonator(r, authToken.ImpersonatorID)
+
+			app.logger.Info(
+				"impersonated request",
+				"admin_id", authToken.ImpersonatorID,
+				"user_id", user.ID,
+				"method", r.Method,
+				"uri", r.URL.RequestURI(),
+			)
+		}
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateSignedToken() helper verifies a signed token and, if it is valid and
+// hasn't been revoked, returns a copy of the request with the user and their
+// permissions (as recorded in the token claims) added to the context. Note that the
+// user only has its ID and activation state set.
+func (app *application) authenticateSignedToken(
+	r *http.Request,
+	token string,
+) (*http.Request, bool) {
+	claims, err := app.signingKeys.Verify(token)
+	if err != nil {
+		return r, false
+	}
+
+	if app.denylist.Contains(claims) {
+		return r, false
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		return r, false
+	}
+
+	user := &data.User{
+		ID:        userID,
+		Activated: claims.Activated,
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetClaims(r, claims)
+	r = app.contextSetPermissions(r, data.Permissions(claims.Permissions))
+
+	return r, true
+}
+
+// The authenticateAPIKey() helper authenticates a request made with an API key. The
+// request is granted the permissions assigned to the key, but only those which the
+// key's owner still holds in the organization that the request acts in, so revoking a
+// permission from a user also revokes it from all of their keys.
+func (app *application) authenticateAPIKey(
+	w http.ResponseWriter,
+	r *http.Request,
+	next http.Handler,
+	keyPlaintext string,
+) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, keyPlaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForKey(keyPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key.ID)
+
+	r, ok := app.selectOrganization(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	ownerPermissions, err := app.userPermissions(user.ID, app.contextGetOrganization(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetPermissions(r, key.Permissions.Intersect(ownerPermissions))
+
+	next.ServeHTTP(w, r)
+}
+
 // Create a new requireAuthenticatedUser() middleware to check that a user is not
 // anonymous.
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
@@ -327,15 +510,62 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// The denyImpersonation() middleware stops an administrator who is impersonating a user
+// from changing how the user logs in, or from creating credentials which would outlive
+// their impersonation token.
+func (app *application) denyImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonator(r) != 0 {
+			app.impersonationNotPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireFirstPartySession() middleware only lets through requests made with a
+// token that the user got by logging in. API keys and tokens issued to OAuth clients
+// are delegated credentials, which mustn't be used to create other credentials (which
+// could outlive them, or carry more permissions) or to take over the account.
+func (app *application) requireFirstPartySession(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != 0 || app.contextGetOAuthClient(r) != 0 {
+			app.delegatedCredentialNotPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The requireTwoFactor() middleware only lets through requests from users who have
+// enabled two-factor authentication. It guards actions (such as changing the movie
+// catalog) which a stolen password alone mustn't be enough to perform, so users who
+// hold the permissions for them have to enrol before they can use them.
+func (app *application) requireTwoFactor(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled, err := app.models.TOTP.IsEnabled(app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !enabled {
+			app.twoFactorRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Note that the first parameter for the middleware function is the permission code that
 // we require the user to have.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
-
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the slice of permissions for the request.
+		permissions, err := app.requestPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
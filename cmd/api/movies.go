@@ -24,11 +24,15 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Record the user who added the movie as its owner, and add it to the catalog of
+	// the organization that the request acts in.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: app.contextGetUser(r).ID,
+		OrgID:     app.contextGetOrganization(r),
 	}
 
 	// Initialize a new Validator.
@@ -44,8 +48,16 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Create the movie using the Insert() method on the movie model,
 	// passing in a pointer to the validated movie struct. This will
 	// create a record in the database and update the movie struct
-	// with the system generated information
-	err = app.models.Movies.Insert(movie)
+	// with the system generated information. The creation is recorded
+	// in the audit log in the same transaction.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Movies.Insert(movie)
+		if err != nil {
+			return err
+		}
+
+		return log.record("movie.create", "movie", movie.ID, nil, movie)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -74,7 +86,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// Call the Get() method to fetch the data for a specific movie.
 	// Check if record was not found and respond with notFoundResponse()
 	// If any other error is returned, respond with serverErrorResponse()
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(r), id)
 	if err != nil && errors.Is(err, data.ErrRecordNotFound) {
 		app.notFoundResponse(w, r)
 		return
@@ -100,7 +112,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Fetch the existing movie from the database and send 404 Not Found
 	// to the client if no matching record was found
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(r), id)
 	if err != nil && errors.Is(err, data.ErrRecordNotFound) {
 		app.notFoundResponse(w, r)
 		return
@@ -109,6 +121,15 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Check that the policy lets the user change this movie (by default, only its
+	// owner or a user with the movies:admin permission can).
+	if !app.authorize(w, r, "movies:update", movieResource(movie)) {
+		return
+	}
+
+	// Keep a copy of the movie as it was, for the audit log.
+	before := *movie
+
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
 		Title   string       `json:"title"`
@@ -139,8 +160,15 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Update the movie record
-	err = app.models.Movies.Update(movie)
+	// Update the movie record, and record the change in the audit log.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Movies.Update(movie)
+		if err != nil {
+			return err
+		}
+
+		return log.record("movie.update", "movie", movie.ID, before, movie)
+	})
 	if err != nil && errors.Is(err, data.ErrEditConflict) {
 		app.editConflictResponse(w, r)
 		return
@@ -163,9 +191,31 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Delete the movie from the database. Send a 404 Not Found response to the
-	// client there is no matching record.
-	err = app.models.Movies.Delete(id)
+	// Fetch the existing movie, so that we can check who owns it.
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(r), id)
+	if err != nil && errors.Is(err, data.ErrRecordNotFound) {
+		app.notFoundResponse(w, r)
+		return
+	} else if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Check that the policy lets the user delete this movie.
+	if !app.authorize(w, r, "movies:delete", movieResource(movie)) {
+		return
+	}
+
+	// Delete the movie from the database, and record the deletion in the audit log.
+	// Send a 404 Not Found response to the client there is no matching record.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Movies.Delete(movie.OrgID, movie.ID)
+		if err != nil {
+			return err
+		}
+
+		return log.record("movie.delete", "movie", movie.ID, movie, nil)
+	})
 	if err != nil && errors.Is(err, data.ErrRecordNotFound) {
 		app.notFoundResponse(w, r)
 		return
@@ -194,7 +244,7 @@ func (app *application) patchMovieHandler(w http.ResponseWriter, r *http.Request
 
 	// Fetch the existing movie from the database and send 404 Not Found
 	// to the client if no matching record was found
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(app.contextGetOrganization(r), id)
 	if err != nil && errors.Is(err, data.ErrRecordNotFound) {
 		app.notFoundResponse(w, r)
 		return
@@ -203,6 +253,15 @@ func (app *application) patchMovieHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Check that the policy lets the user change this movie (by default, only its
+	// owner or a user with the movies:admin permission can).
+	if !app.authorize(w, r, "movies:update", movieResource(movie)) {
+		return
+	}
+
+	// Keep a copy of the movie as it was, for the audit log.
+	before := *movie
+
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
 		Title   *string       `json:"title"`
@@ -247,9 +306,16 @@ func (app *application) patchMovieHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Update the movie record
-	err = app.models.Movies.Update(movie)
-	if err != nil && errors.Is(err, data.ErrRecordNotFound) {
+	// Update the movie record, and record the change in the audit log.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Movies.Update(movie)
+		if err != nil {
+			return err
+		}
+
+		return log.record("movie.update", "movie", movie.ID, before, movie)
+	})
+	if err != nil && errors.Is(err, data.ErrEditConflict) {
 		app.editConflictResponse(w, r)
 		return
 	} else if err != nil {
@@ -267,8 +333,9 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// To keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string.
 	var input struct {
-		Title  string
-		Genres []string
+		Title   string
+		Genres  []string
+		OwnerID int64
 		data.Filters
 	}
 
@@ -284,6 +351,10 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
+	// Optionally only list the movies added by a specific user.
+	input.OwnerID = int64(app.readInt(qs, "owner_id", 0, v))
+	v.Check(input.OwnerID >= 0, "owner_id", "must be a positive integer")
+
 	// Get the page and page_size query string values as integers. Notice that we set
 	// the default page value to 1 and default page_size to 20, and that we pass the
 	// validator instance as the final argument here.
@@ -314,7 +385,13 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(
+		app.contextGetOrganization(r),
+		input.Title,
+		input.Genres,
+		input.OwnerID,
+		input.Filters,
+	)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
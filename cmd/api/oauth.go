@@ -0,0 +1,667 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// The oauthAuthorizationRequest type holds the parameters of an OAuth 2.0 authorization
+// request (RFC 6749 section 4.1.1), including the PKCE code challenge (RFC 7636). We
+// require PKCE for every client, confidential or not.
+type oauthAuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	client := &data.OAuthClient{
+		UserID:       user.ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential,
+	}
+
+	v := validator.New()
+
+	if data.ValidateOAuthClient(v, client); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A client can only request permissions which the user registering it holds.
+	err = app.validateHeldPermissions(v, r, "scopes", client.Scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuthClients.Insert(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// This is the only time that the client secret is ever included in a response, as
+	// we only store its hash.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.models.OAuthClients.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.OAuthClients.DeleteForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "client successfully deleted"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showOAuthAuthorizationHandler() is called by the frontend when a client sends the
+// user to the authorization endpoint. It checks the authorization request and returns
+// the details that the frontend needs to show the consent screen: the client's name and
+// the permissions it would be granted.
+func (app *application) showOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := oauthAuthorizationRequest{
+		ResponseType:        app.readString(qs, "response_type", ""),
+		ClientID:            app.readString(qs, "client_id", ""),
+		RedirectURI:         app.readString(qs, "redirect_uri", ""),
+		Scope:               app.readString(qs, "scope", ""),
+		State:               app.readString(qs, "state", ""),
+		CodeChallenge:       app.readString(qs, "code_challenge", ""),
+		CodeChallengeMethod: app.readString(qs, "code_challenge_method", ""),
+	}
+
+	v := validator.New()
+
+	client, scopes, err := app.checkOAuthAuthorizationRequest(v, r, &req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{
+		"authorization": map[string]any{
+			"client_id":    client.ClientID,
+			"client_name":  client.Name,
+			"redirect_uri": req.RedirectURI,
+			"scopes":       scopes,
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createOAuthAuthorizationHandler() records the user's decision on the consent
+// screen. If they approve the request, a short-lived authorization code is issued. In
+// either case, the response contains the URI that the frontend should redirect the user
+// back to.
+func (app *application) createOAuthAuthorizationHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	var input struct {
+		oauthAuthorizationRequest
+		Approved bool `json:"approved"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	req := input.oauthAuthorizationRequest
+
+	// Remember whether the client named a redirect URI, before the check fills in a
+	// default, because then it must name the same one when exchanging the code.
+	requestedRedirectURI := req.RedirectURI
+
+	v := validator.New()
+
+	client, scopes, err := app.checkOAuthAuthorizationRequest(v, r, &req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	params := url.Values{}
+
+	if input.Approved {
+		code := &data.OAuthCode{
+			ClientID:      client.ID,
+			UserID:        app.contextGetUser(r).ID,
+			RedirectURI:   requestedRedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: req.CodeChallenge,
+		}
+
+		// Authorization codes should be exchanged straight away, so we only allow a
+		// few minutes for the client to do so.
+		err = app.models.OAuthCodes.New(code, 5*time.Minute)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		params.Set("code", code.Plaintext)
+	} else {
+		params.Set("error", "access_denied")
+	}
+
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	// The redirect URI has already been checked against the client's registered URIs,
+	// so we know that it parses.
+	redirectURI, _ := url.Parse(req.RedirectURI)
+
+	query := redirectURI.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	redirectURI.RawQuery = query.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_uri": redirectURI.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkOAuthAuthorizationRequest() helper validates an authorization request made
+// by the authenticated user, recording any problems in the validator. If the request
+// doesn't include a redirect URI and the client only has one, it is filled in. It
+// returns the client along with the scopes that would be granted, which are those
+// requested (or all of the client's scopes, if none were) that the user holds.
+func (app *application) checkOAuthAuthorizationRequest(
+	v *validator.Validator,
+	r *http.Request,
+	req *oauthAuthorizationRequest,
+) (*data.OAuthClient, data.Permissions, error) {
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	v.Check(len(req.State) <= 500, "state", "must not be more than 500 bytes long")
+	data.ValidateCodeChallenge(v, req.CodeChallenge, req.CodeChallengeMethod)
+
+	if req.ClientID == "" {
+		return nil, nil, nil
+	}
+
+	client, err := app.models.OAuthClients.GetByClientID(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "is invalid")
+			return nil, nil, nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+
+	v.Check(
+		slices.Contains(client.RedirectURIs, req.RedirectURI),
+		"redirect_uri",
+		"must be one of the client's registered redirect URIs",
+	)
+
+	requested := data.Permissions(strings.Fields(req.Scope))
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+
+	for _, scope := range requested {
+		v.Check(client.Scopes.Include(scope), "scope", "must only contain the client's scopes")
+	}
+
+	if !v.Valid() {
+		return client, nil, nil
+	}
+
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scopes := requested.Intersect(permissions)
+
+	v.Check(len(scopes) >= 1, "scope", "must contain at least 1 permission that you hold")
+
+	return client, scopes, nil
+}
+
+// The createOAuthTokenHandler() is the OAuth 2.0 token endpoint. As required by the
+// specification, it accepts form-encoded parameters and supports the authorization_code
+// and refresh_token grant types.
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	client, err := app.authenticateOAuthClient(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if client == nil {
+		app.oauthErrorResponse(
+			w,
+			r,
+			http.StatusUnauthorized,
+			"invalid_client",
+			"client authentication failed",
+		)
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		app.exchangeOAuthAuthorizationCode(w, r, client)
+	case "refresh_token":
+		app.refreshOAuthToken(w, r, client)
+	default:
+		app.oauthErrorResponse(
+			w,
+			r,
+			http.StatusBadRequest,
+			"unsupported_grant_type",
+			"grant_type must be authorization_code or refresh_token",
+		)
+	}
+}
+
+func (app *application) exchangeOAuthAuthorizationCode(
+	w http.ResponseWriter,
+	r *http.Request,
+	client *data.OAuthClient,
+) {
+	var (
+		codePlaintext = r.PostForm.Get("code")
+		redirectURI   = r.PostForm.Get("redirect_uri")
+		codeVerifier  = r.PostForm.Get("code_verifier")
+	)
+
+	if codePlaintext == "" || !data.CodeVerifierRX.MatchString(codeVerifier) {
+		app.oauthErrorResponse(
+			w,
+			r,
+			http.StatusBadRequest,
+			"invalid_request",
+			"code and a valid code_verifier must be provided",
+		)
+		return
+	}
+
+	// Consuming the code deletes it, so each code can only be tried once.
+	code, err := app.models.OAuthCodes.Consume(codePlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthGrantResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// As RFC 6749 requires, if the authorization request included a redirect URI, the
+	// token request must include the same one.
+	if code.ClientID != client.ID ||
+		(code.RedirectURI != "" && redirectURI != code.RedirectURI) ||
+		!code.VerifyCodeVerifier(codeVerifier) {
+		app.invalidOAuthGrantResponse(w, r)
+		return
+	}
+
+	app.issueOAuthTokens(w, r, client, code.UserID, data.NewTokenFamily(), code.Scopes)
+}
+
+func (app *application) refreshOAuthToken(
+	w http.ResponseWriter,
+	r *http.Request,
+	client *data.OAuthClient,
+) {
+	token, err := app.models.Tokens.Consume(
+		data.ScopeOAuthRefresh,
+		r.PostForm.Get("refresh_token"),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthGrantResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn(
+				"OAuth refresh token reused, token family revoked",
+				"client_id", client.ClientID,
+				"ip", realip.FromRequest(r),
+			)
+			app.invalidOAuthGrantResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A refresh token presented by a different client has been stolen, so we revoke
+	// the whole family.
+	if token.ClientID != client.ID {
+		err = app.audit(r, func(tx data.Models, log *auditLog) error {
+			log.setActor(token.UserID)
+
+			err := tx.Tokens.DeleteAllInFamily(token.Family)
+			if err != nil {
+				return err
+			}
+
+			return log.record("token.delete", "token", token.UserID, tokenAudit(token), nil)
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidOAuthGrantResponse(w, r)
+		return
+	}
+
+	app.issueOAuthTokens(w, r, client, token.UserID, token.Family, token.Permissions)
+}
+
+// The issueOAuthTokens() helper issues an access token and a refresh token to a client,
+// restricted to the given permissions, and sends them in the format described in RFC
+// 6749 section 5.1. The access token is an ordinary opaque authentication token, so it
+// works with the authenticate() and requirePermission() middleware.
+func (app *application) issueOAuthTokens(
+	w http.ResponseWriter,
+	r *http.Request,
+	client *data.OAuthClient,
+	userID int64,
+	family string,
+	permissions data.Permissions,
+) {
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthGrantResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		app.invalidOAuthGrantResponse(w, r)
+		return
+	}
+
+	var accessToken, refreshToken *data.Token
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		log.setActor(user.ID)
+
+		var err error
+
+		accessToken, err = tx.Tokens.NewForClient(
+			user.ID,
+			app.config.auth.accessTokenTTL,
+			data.ScopeAuthentication,
+			family,
+			client.ID,
+			permissions,
+		)
+		if err != nil {
+			return err
+		}
+
+		refreshToken, err = tx.Tokens.NewForClient(
+			user.ID,
+			app.config.auth.refreshTokenTTL,
+			data.ScopeOAuthRefresh,
+			family,
+			client.ID,
+			permissions,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("token.create", "token", user.ID, nil, tokenAudit(accessToken))
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.create", "token", user.ID, nil, tokenAudit(refreshToken))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"access_token":  accessToken.Plaintext,
+		"token_type":    "Bearer",
+		"expires_in":    int(app.config.auth.accessTokenTTL.Seconds()),
+		"refresh_token": refreshToken.Plaintext,
+		"scope":         strings.Join(permissions, " "),
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeOAuthTokenHandler() is the OAuth 2.0 token revocation endpoint (RFC 7009).
+// Revoking either token revokes the whole grant. As the specification requires, we
+// respond with 200 OK even if the token is invalid or was already revoked.
+func (app *application) revokeOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	client, err := app.authenticateOAuthClient(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if client == nil {
+		app.oauthErrorResponse(
+			w,
+			r,
+			http.StatusUnauthorized,
+			"invalid_client",
+			"client authentication failed",
+		)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		app.oauthErrorResponse(
+			w,
+			r,
+			http.StatusBadRequest,
+			"invalid_request",
+			"token must be provided",
+		)
+		return
+	}
+
+	// The client is the only thing we know about the grant until the token is looked
+	// up, so the revocation is recorded against the client.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Tokens.DeleteFamilyForClient(client.ID, token)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.revoke", "oauth_client", client.ID, nil, nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "token revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The authenticateOAuthClient() helper identifies the client making a request to the
+// token or revocation endpoint. Confidential clients must provide their secret, either
+// using HTTP Basic authentication or in the client_secret form parameter. Public clients
+// just provide their client_id. If the client can't be authenticated, nil is returned.
+func (app *application) authenticateOAuthClient(r *http.Request) (*data.OAuthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// Credentials in the Basic authentication header are form-encoded (RFC 6749
+		// section 2.3.1).
+		var err1, err2 error
+
+		clientID, err1 = url.QueryUnescape(clientID)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return nil, nil
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		return nil, nil
+	}
+
+	client, err := app.models.OAuthClients.GetByClientID(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	if client.Confidential && !client.SecretMatches(secret) {
+		return nil, nil
+	}
+
+	if !client.Confidential && secret != "" {
+		return nil, nil
+	}
+
+	return client, nil
+}
+
+func (app *application) invalidOAuthGrantResponse(w http.ResponseWriter, r *http.Request) {
+	app.oauthErrorResponse(
+		w,
+		r,
+		http.StatusBadRequest,
+		"invalid_grant",
+		"the authorization code or refresh token is invalid, expired or revoked",
+	)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// Clients choose which organization a request acts in by sending its ID in this
+// header. Requests made without it act in the user's default organization.
+const organizationHeader = "X-Organization-ID"
+
+var (
+	errInvalidOrganization   = errors.New("invalid organization ID")
+	errNotOrganizationMember = errors.New("not a member of the organization")
+)
+
+// The resolveOrganization() helper works out which organization a request made by a
+// user acts in, given the value of its X-Organization-ID header: the organization that
+// the header names, which the user must belong to, or if it is empty the user's
+// default organization. It returns 0 if the user doesn't belong to any organization.
+func (app *application) resolveOrganization(header string, userID int64) (int64, error) {
+	if header == "" {
+		orgID, err := app.models.Organizations.GetDefaultForUser(userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return 0, nil
+			default:
+				return 0, err
+			}
+		}
+
+		return orgID, nil
+	}
+
+	orgID, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || orgID < 1 {
+		return 0, errInvalidOrganization
+	}
+
+	member, err := app.models.Organizations.IsMember(orgID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if !member {
+		return 0, errNotOrganizationMember
+	}
+
+	return orgID, nil
+}
+
+// The selectOrganization() helper adds the organization that an authenticated request
+// acts in to the request context. Signed tokens are only valid in the organization
+// that they were issued for, so for them the header can only confirm the organization
+// recorded in the token's claims. If the organization can't be used, it sends an error
+// response and returns false.
+func (app *application) selectOrganization(w http.ResponseWriter, r *http.Request, userID int64) (*http.Request, bool) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		header := r.Header.Get(organizationHeader)
+
+		if header != "" && header != strconv.FormatInt(claims.OrgID, 10) {
+			app.organizationNotPermittedResponse(w, r)
+			return r, false
+		}
+
+		return app.contextSetOrganization(r, claims.OrgID), true
+	}
+
+	orgID, err := app.resolveOrganization(r.Header.Get(organizationHeader), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidOrganization):
+			app.badRequestResponse(w, r, errors.New("the "+organizationHeader+" header must contain an organization ID"))
+		case errors.Is(err, errNotOrganizationMember):
+			app.organizationNotPermittedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return r, false
+	}
+
+	return app.contextSetOrganization(r, orgID), true
+}
+
+// The listCurrentUserOrganizationsHandler() returns the organizations that the
+// authenticated user belongs to, along with the ID of the one that the request acted
+// in.
+func (app *application) listCurrentUserOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	orgs, err := app.models.Organizations.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"organizations": orgs, "active_organization_id": app.contextGetOrganization(r)}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listOrganizationsHandler() returns every organization.
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	orgs, err := app.models.Organizations.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organizations": orgs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createOrganizationHandler() creates a new, empty organization. Members can then
+// be added to it, and given roles and permissions there by its administrators.
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	org := &data.Organization{
+		Name: input.Name,
+		Slug: input.Slug,
+	}
+
+	v := validator.New()
+
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Organizations.Insert(org)
+		if err != nil {
+			return err
+		}
+
+		return log.record("organization.create", "organization", org.ID, nil, org)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateSlug):
+			v.AddError("slug", "an organization with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.Info("organization created", "admin_id", app.contextGetUser(r).ID, "org_id", org.ID)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"organization": org}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The addOrganizationMemberHandler() adds an existing user to an organization. The
+// user doesn't get any permissions there until they are granted some.
+func (app *application) addOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	org, userID, ok := app.readOrganizationMember(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Organizations.AddMember(org.ID, userID)
+		if err != nil {
+			return err
+		}
+
+		member := map[string]any{"user_id": userID}
+		return log.record("organization.member_add", "organization", org.ID, nil, member)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info("organization member added", "admin_id", app.contextGetUser(r).ID, "org_id", org.ID, "user_id", userID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully added to organization"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The removeOrganizationMemberHandler() removes a user from an organization, along
+// with the permissions and roles that they held there.
+func (app *application) removeOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	org, userID, ok := app.readOrganizationMember(w, r)
+	if !ok {
+		return
+	}
+
+	// Removing a member takes away their permissions and roles in the organization, so
+	// make sure that it isn't left without an administrator.
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := app.guardLastAdmin(tx, func() error {
+			return tx.Organizations.RemoveMember(org.ID, userID)
+		})
+		if err != nil {
+			return err
+		}
+
+		member := map[string]any{"user_id": userID}
+		return log.record("organization.member_remove", "organization", org.ID, member, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "user_id")
+		case errors.Is(err, data.ErrRecordNotFound):
+			v := validator.New()
+			v.AddError("user_id", "is not a member of this organization")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.Info("organization member removed", "admin_id", app.contextGetUser(r).ID, "org_id", org.ID, "user_id", userID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully removed from organization"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readOrganizationMember() helper looks up the organization whose ID is given in
+// the URL, and reads the ID of an existing user from the request body. If anything is
+// wrong, it sends an error response and returns false.
+func (app *application) readOrganizationMember(w http.ResponseWriter, r *http.Request) (*data.Organization, int64, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return nil, 0, false
+	}
+
+	org, err := app.models.Organizations.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, 0, false
+	}
+
+	var input struct {
+		UserID int64 `json:"user_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, 0, false
+	}
+
+	v := validator.New()
+
+	v.Check(input.UserID > 0, "user_id", "must be a positive integer")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, 0, false
+	}
+
+	_, err = app.models.Users.Get(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, 0, false
+	}
+
+	return org, input.UserID, true
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/lib/pq"
+)
+
+// permissionsChannel is the Postgres notification channel on which changes to users'
+// permissions are announced. The payload is the ID of the affected user, or "*" if any
+// number of users may be affected.
+const permissionsChannel = "permissions_changed"
+
+// permissionCacheMaxEntries bounds the memory used by the permission cache. When it is
+// full, expired entries are removed, and if that isn't enough the cache is emptied.
+const permissionCacheMaxEntries = 100_000
+
+// A user's permissions depend on the organization, so they are cached for each
+// organization separately.
+type permissionCacheKey struct {
+	userID int64
+	orgID  int64
+}
+
+type permissionCacheEntry struct {
+	permissions data.Permissions
+	expiry      time.Time
+}
+
+// The permissionCache type holds recently looked up permissions in memory, so that we
+// don't need to query the database on every request which requires a permission.
+// Entries expire after the TTL, but are normally removed well before then, when the
+// database notifies us that they have changed.
+type permissionCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[permissionCacheKey]permissionCacheEntry
+
+	// The generation is incremented on every invalidation. A lookup only stores its
+	// result if no invalidation happened while it was reading from the database, as
+	// otherwise it could cache permissions which have just been changed.
+	generation uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newPermissionCache(ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		ttl:     ttl,
+		entries: make(map[permissionCacheKey]permissionCacheEntry),
+	}
+}
+
+// Get() returns the cached permissions for a user in an organization, if there are any.
+// If there aren't, the returned generation should be passed to Set() along with the
+// permissions read from the database.
+func (c *permissionCache) Get(userID, orgID int64) (data.Permissions, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, found := c.entries[permissionCacheKey{userID, orgID}]
+	if !found || time.Now().After(entry.expiry) {
+		c.misses.Add(1)
+		return nil, c.generation, false
+	}
+
+	c.hits.Add(1)
+	return entry.permissions, c.generation, true
+}
+
+// Set() caches the permissions for a user in an organization, unless the cache has been
+// invalidated since the given generation.
+func (c *permissionCache) Set(userID, orgID int64, permissions data.Permissions, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if len(c.entries) >= permissionCacheMaxEntries {
+		now := time.Now()
+
+		for key, entry := range c.entries {
+			if now.After(entry.expiry) {
+				delete(c.entries, key)
+			}
+		}
+
+		if len(c.entries) >= permissionCacheMaxEntries {
+			clear(c.entries)
+		}
+	}
+
+	c.entries[permissionCacheKey{userID, orgID}] = permissionCacheEntry{
+		permissions: permissions,
+		expiry:      time.Now().Add(c.ttl),
+	}
+}
+
+// Delete() removes the cached permissions for a user, in every organization.
+func (c *permissionCache) Delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	for key := range c.entries {
+		if key.userID == userID {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear() removes every entry from the cache.
+func (c *permissionCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+}
+
+// Stats() returns the cache's hit and miss counts, hit ratio and size, for publishing
+// in the metrics.
+func (c *permissionCache) Stats() map[string]any {
+	c.mu.RLock()
+	entries := len(c.entries)
+	c.mu.RUnlock()
+
+	hits := c.hits.Load()
+	misses := c.misses.Load()
+
+	var ratio float64
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+
+	return map[string]any{
+		"hits":      hits,
+		"misses":    misses,
+		"hit_ratio": ratio,
+		"entries":   entries,
+	}
+}
+
+// The userPermissions() helper returns a user's effective permissions in an
+// organization, from the cache if possible.
+func (app *application) userPermissions(userID, orgID int64) (data.Permissions, error) {
+	if app.permissionCache == nil {
+		return app.models.Permissions.GetAllForUser(userID, orgID)
+	}
+
+	permissions, generation, found := app.permissionCache.Get(userID, orgID)
+	if found {
+		return permissions, nil
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.permissionCache.Set(userID, orgID, permissions, generation)
+
+	return permissions, nil
+}
+
+// The listenForPermissionChanges() helper listens for notifications that users'
+// permissions have changed (sent by triggers on the permission tables), and removes
+// the affected entries from the cache, so that changes made through any instance take
+// effect everywhere straight away. If the connection is lost, notifications may have
+// been missed, so the whole cache is cleared once it is re-established.
+func (app *application) listenForPermissionChanges(dsn string) error {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		if event == pq.ListenerEventDisconnected {
+			app.permissionCache.Clear()
+		}
+	})
+
+	err := listener.Listen(permissionsChannel)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case notification := <-listener.Notify:
+				// A nil notification is sent after the connection has been
+				// re-established.
+				if notification == nil {
+					app.permissionCache.Clear()
+					continue
+				}
+
+				if notification.Extra == "*" {
+					app.permissionCache.Clear()
+					continue
+				}
+
+				userID, err := strconv.ParseInt(notification.Extra, 10, 64)
+				if err != nil {
+					app.permissionCache.Clear()
+					continue
+				}
+
+				app.permissionCache.Delete(userID)
+
+			// Check the connection every so often, so that we notice if it is lost
+			// even when nothing is changing.
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// The listPermissionsHandler() returns every permission code that can be granted.
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserPermissionsHandler() returns the permissions granted to a user directly
+// in the administrator's organization, along with their effective permissions there
+// (which include those granted by their roles).
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The grantUserPermissionsHandler() grants permissions to a user directly, in the
+// administrator's organization. Permissions which the user already holds are ignored.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.readPermissionCodes(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.changeUserPermissions(r, "permission.grant", user.ID, func(tx data.Models) error {
+		return tx.Permissions.AddForUser(user.ID, app.contextGetOrganization(r), codes...)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.Info(
+		"permissions granted",
+		"admin_id", app.contextGetUser(r).ID,
+		"org_id", app.contextGetOrganization(r),
+		"user_id", user.ID,
+		"permissions", codes,
+	)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The revokeUserPermissionsHandler() revokes permissions which were granted to a user
+// directly in the administrator's organization. The user keeps any of the permissions
+// which they hold through their roles.
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.readPermissionCodes(w, r)
+	if !ok {
+		return
+	}
+
+	orgID := app.contextGetOrganization(r)
+
+	// Make sure that the change doesn't leave nobody able to manage permissions.
+	err := app.changeUserPermissions(r, "permission.revoke", user.ID, func(tx data.Models) error {
+		return app.guardLastAdmin(tx, func() error {
+			return tx.Permissions.RemoveForUser(user.ID, orgID, codes...)
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "permissions")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.Info(
+		"permissions revoked",
+		"admin_id", app.contextGetUser(r).ID,
+		"org_id", orgID,
+		"user_id", user.ID,
+		"permissions", codes,
+	)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The readPermissionCodes() helper reads a list of permission codes from the request
+// body, and checks that they all exist and are held by the administrator making the
+// request, so that administrators can't grant themselves (or anybody else) more than
+// they already have. If anything is wrong, it sends an error response and returns
+// false.
+func (app *application) readPermissionCodes(w http.ResponseWriter, r *http.Request) (data.Permissions, bool) {
+	var input struct {
+		Permissions data.Permissions `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+
+	all, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	for _, code := range input.Permissions {
+		v.Check(all.Include(code), "permissions", "must only contain existing permissions ("+code+" is not one)")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	err = app.validateHeldPermissions(v, r, "permissions", input.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return input.Permissions, true
+}
+
+// errLastAdmin is returned by guardLastAdmin() when a change would leave an
+// organization without anybody able to manage permissions.
+var errLastAdmin = errors.New("change would remove the last administrator")
+
+// The guardLastAdmin() helper makes a change which may take permissions away from users
+// (by revoking them, changing roles, removing members, or deactivating or deleting
+// users), and returns errLastAdmin if it leaves any organization which had an
+// administrator without one, as nobody there would then be able to give admin access
+// back. It must be called on models running in a transaction, which should be rolled
+// back if an error is returned. Such changes are serialized, so that two of them can't
+// each remove a different administrator.
+func (app *application) guardLastAdmin(tx data.Models, change func() error) error {
+	err := tx.Permissions.LockHolders()
+	if err != nil {
+		return err
+	}
+
+	before, err := tx.Permissions.GetOrganizationsWithHolders("permissions:admin")
+	if err != nil {
+		return err
+	}
+
+	err = change()
+	if err != nil {
+		return err
+	}
+
+	after, err := tx.Permissions.GetOrganizationsWithHolders("permissions:admin")
+	if err != nil {
+		return err
+	}
+
+	for _, orgID := range before {
+		if !slices.Contains(after, orgID) {
+			return errLastAdmin
+		}
+	}
+
+	return nil
+}
+
+// The lastAdminResponse() helper sends a validation error, against the given key, for a
+// change refused by guardLastAdmin().
+func (app *application) lastAdminResponse(w http.ResponseWriter, r *http.Request, key string) {
+	v := validator.New()
+	v.AddError(key, "must not remove admin access from the last administrator")
+	app.failedValidationResponse(w, r, v.Errors)
+}
+
+// The writeUserPermissions() helper sends a response containing a user's direct and
+// effective permissions in the organization that the request acts in.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	orgID := app.contextGetOrganization(r)
+
+	direct, err := app.models.Permissions.GetDirectForUser(userID, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	effective, err := app.models.Permissions.GetAllForUser(userID, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if direct == nil {
+		direct = data.Permissions{}
+	}
+
+	if effective == nil {
+		effective = data.Permissions{}
+	}
+
+	env := envelope{"permissions": direct, "effective_permissions": effective}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The changeUserPermissions() helper calls change to grant or revoke permissions which
+// are held by a user directly, in the organization that the request acts in, and
+// records the permissions that the user held directly before and after the change in
+// the audit log. If the user loses any permissions, their signed tokens are revoked.
+func (app *application) changeUserPermissions(
+	r *http.Request,
+	action string,
+	userID int64,
+	change func(tx data.Models) error,
+) error {
+	orgID := app.contextGetOrganization(r)
+
+	return app.audit(r, func(tx data.Models, log *auditLog) error {
+		before, err := tx.Permissions.GetDirectForUser(userID, orgID)
+		if err != nil {
+			return err
+		}
+
+		effective, err := tx.Permissions.GetAllForUser(userID, orgID)
+		if err != nil {
+			return err
+		}
+
+		err = change(tx)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.Permissions.GetDirectForUser(userID, orgID)
+		if err != nil {
+			return err
+		}
+
+		err = log.record(
+			action,
+			"user",
+			userID,
+			permissionsAudit(orgID, before...),
+			permissionsAudit(orgID, after...),
+		)
+		if err != nil {
+			return err
+		}
+
+		return app.revokeRemovedPermissions(tx, log, userID, orgID, effective)
+	})
+}
+
+// The revokeRemovedPermissions() helper compares the permissions that a user holds in
+// an organization with those they held before a change. Signed access tokens carry the
+// user's permissions, so if any have been taken away, the user is logged out
+// everywhere and their token families are revoked; otherwise they could keep using the
+// permissions until their access tokens expire. If signed tokens aren't in use, the
+// permissions are checked on every request and it does nothing. It must be called on
+// models running in a transaction.
+func (app *application) revokeRemovedPermissions(
+	tx data.Models,
+	log *auditLog,
+	userID int64,
+	orgID int64,
+	before data.Permissions,
+) error {
+	if app.denylist == nil {
+		return nil
+	}
+
+	after, err := tx.Permissions.GetAllForUser(userID, orgID)
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(before, func(code string) bool { return !after.Include(code) }) {
+		return nil
+	}
+
+	families, err := tx.Tokens.DeleteAllSessionsForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	err = app.revokeTokenFamilies(tx, families)
+	if err != nil {
+		return err
+	}
+
+	return log.record("token.delete", "token", userID, map[string]any{"sessions": "all"}, nil)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/policy"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// The resourceLoaders map holds a function for each type of resource that the policy
+// explain endpoint can look up by ID, within an organization.
+var resourceLoaders = map[string]func(app *application, orgID, id int64) (policy.Resource, error){
+	"movie": func(app *application, orgID, id int64) (policy.Resource, error) {
+		movie, err := app.models.Movies.Get(orgID, id)
+		if err != nil {
+			return policy.Resource{}, err
+		}
+
+		return movieResource(movie), nil
+	},
+}
+
+// The movieResource() helper returns the attributes of a movie that policy rules can
+// use.
+func movieResource(movie *data.Movie) policy.Resource {
+	return policy.Resource{
+		Type: "movie",
+		Attributes: policy.Attributes{
+			"id":         movie.ID,
+			"created_by": movie.CreatedBy,
+			"org_id":     movie.OrgID,
+			"title":      movie.Title,
+			"year":       movie.Year,
+			"genres":     movie.Genres,
+		},
+	}
+}
+
+// The builtinSubjectAttributes are the subject attributes which subjectAttributes()
+// always sets. Members can't be given attributes with these names, so that they can't
+// be used to get around rules which rely on them.
+var builtinSubjectAttributes = []string{"id", "activated", "org_id", "permissions", "roles"}
+
+// The subjectAttributes() helper returns the attributes of a user acting in an
+// organization that policy rules can use: their ID, whether they are activated, the
+// organization's ID, and their effective permissions and the names of their roles
+// there, along with any attributes which an administrator has given them as a member
+// of the organization (such as the genres that an editor is assigned to).
+func (app *application) subjectAttributes(
+	user *data.User,
+	orgID int64,
+	permissions data.Permissions,
+) (policy.Attributes, error) {
+	roles, err := app.models.Roles.GetAllForUser(user.ID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	roleNames := make([]string, len(roles))
+	for i, role := range roles {
+		roleNames[i] = role.Name
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	attributes, err := app.models.Organizations.GetMemberAttributes(orgID, user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	subject := policy.Attributes{}
+	for name, value := range attributes {
+		subject[name] = value
+	}
+
+	subject["id"] = user.ID
+	subject["activated"] = user.Activated
+	subject["org_id"] = orgID
+	subject["permissions"] = []string(permissions)
+	subject["roles"] = roleNames
+
+	return subject, nil
+}
+
+// The authorize() helper checks whether the policy allows the current request to
+// perform an action on a resource which the handler has loaded. The subject's
+// permissions are those of the request, so restricted API keys and tokens are limited
+// to what they carry. If the action isn't allowed, it sends an error response and
+// returns false.
+func (app *application) authorize(w http.ResponseWriter, r *http.Request, action string, resource policy.Resource) bool {
+	permissions, err := app.requestPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	subject, err := app.subjectAttributes(app.contextGetUser(r), app.contextGetOrganization(r), permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	decision := app.policy.Evaluate(subject, action, resource)
+	if !decision.Allowed {
+		app.logger.Debug(
+			"policy denied request",
+			"user_id", subject["id"],
+			"action", action,
+			"resource", resource.Type,
+			"reason", decision.Reason,
+		)
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// The explainPolicyHandler() evaluates the policy for a user, action and resource
+// without performing the action, and returns the decision along with how each rule
+// was evaluated, to help debug unexpected denials. If no user is given, the decision
+// is for the administrator making the request. The user and resource must both belong
+// to the administrator's organization.
+func (app *application) explainPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID       int64  `json:"user_id"`
+		Action       string `json:"action"`
+		ResourceType string `json:"resource_type"`
+		ResourceID   int64  `json:"resource_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.UserID >= 0, "user_id", "must be a positive integer")
+	v.Check(input.Action != "", "action", "must be provided")
+	v.Check(input.ResourceType != "", "resource_type", "must be provided")
+	v.Check(input.ResourceID > 0, "resource_id", "must be a positive integer")
+
+	load, ok := resourceLoaders[input.ResourceType]
+	v.Check(input.ResourceType == "" || ok, "resource_type", "is not a known resource type")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	orgID := app.contextGetOrganization(r)
+
+	if input.UserID != 0 && input.UserID != user.ID {
+		user, err = app.models.Users.Get(input.UserID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("user_id", "does not exist")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		member, err := app.models.Organizations.IsMember(orgID, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !member {
+			v.AddError("user_id", "does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	resource, err := load(app, orgID, input.ResourceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("resource_id", "does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Explain the decision for the user's full permissions, as if they were using a
+	// normal authentication token.
+	permissions, err := app.userPermissions(user.ID, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	subject, err := app.subjectAttributes(user, orgID, permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	decision := app.policy.Evaluate(subject, input.Action, resource)
+
+	env := envelope{"decision": decision, "subject": subject, "resource": resource}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserAttributesHandler() returns the attributes which a user has been given
+// as a member of the administrator's organization.
+func (app *application) showUserAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	attributes, err := app.models.Organizations.GetMemberAttributes(app.contextGetOrganization(r), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"attributes": attributes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserAttributesHandler() replaces the attributes which a user has been
+// given as a member of the administrator's organization. Policy rules can compare
+// these with the attributes of resources, for example to let editors update the movies
+// in the genres that they are assigned to.
+func (app *application) updateUserAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Attributes map[string]any `json:"attributes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateAttributes(v, input.Attributes)
+
+	for _, name := range builtinSubjectAttributes {
+		_, exists := input.Attributes[name]
+		v.Check(!exists, "attributes", "must not include "+name+", which is set automatically")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	orgID := app.contextGetOrganization(r)
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		before, err := tx.Organizations.GetMemberAttributes(orgID, user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Organizations.SetMemberAttributes(orgID, user.ID, input.Attributes)
+		if err != nil {
+			return err
+		}
+
+		return log.record(
+			"user.attributes_update",
+			"user",
+			user.ID,
+			attributesAudit(orgID, before),
+			attributesAudit(orgID, input.Attributes),
+		)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"attributes": input.Attributes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The attributesAudit() helper returns the details recorded in the audit log when a
+// user's attributes in an organization are changed.
+func attributesAudit(orgID int64, attributes map[string]any) map[string]any {
+	return map[string]any{"org_id": orgID, "attributes": attributes}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/ratelimit"
+	"github.com/tomasen/realip"
+)
+
+// The rateLimitPolicy type decides which limits apply to each request, and which keys
+// the request is counted against. Requests are limited in two passes:
+//
+//   - Before authentication, every request is counted per IP address, so that
+//     guessing passwords, tokens or API keys is throttled. Requests without
+//     credentials get the anonymous limit, and requests with a bearer token or API key
+//     get the more generous ip limit, which allows for several users sharing an
+//     address (for example, behind a corporate NAT).
+//   - After authentication, requests are also counted per user or per API key, so
+//     that each caller has their own limit regardless of where they connect from.
+//     Requests which had credentials but end up anonymous are counted against the
+//     anonymous limit instead.
+//
+// Routes can override the limit in either pass (for example, to be stricter on
+// endpoints which check passwords) or be exempt from rate limiting altogether. A
+// route's requests are counted separately from the rest of the caller's requests, per
+// IP address before authentication and per user or API key afterwards.
+type rateLimitPolicy struct {
+	anonymous ratelimit.Limit
+	ip        ratelimit.Limit
+	user      ratelimit.Limit
+	apiKey    ratelimit.Limit
+	routes    []rateLimitRoute
+}
+
+// The rateLimitRoute type overrides the limit for the requests which match a method
+// and path pattern. Patterns use the same syntax as the router, so ":name" matches a
+// single path segment and "*name" matches the rest of the path. The method may be "*"
+// to match every method.
+type rateLimitRoute struct {
+	name     string
+	method   string
+	segments []string
+	limit    ratelimit.Limit
+	exempt   bool
+}
+
+// The newRateLimitPolicy() function builds the rate limit policy from the
+// configuration. Route overrides are given as "<method>:<pattern>=<rps>:<burst>", or
+// "<method>:<pattern>=exempt".
+func newRateLimitPolicy(cfg config) (*rateLimitPolicy, error) {
+	policy := &rateLimitPolicy{
+		anonymous: ratelimit.Limit{Rate: cfg.limiter.rps, Burst: cfg.limiter.burst},
+		ip:        ratelimit.Limit{Rate: cfg.limiter.ipRPS, Burst: cfg.limiter.ipBurst},
+		user:      ratelimit.Limit{Rate: cfg.limiter.userRPS, Burst: cfg.limiter.userBurst},
+		apiKey:    ratelimit.Limit{Rate: cfg.limiter.apiKeyRPS, Burst: cfg.limiter.apiKeyBurst},
+	}
+
+	for tier, limit := range map[string]ratelimit.Limit{
+		"anonymous": policy.anonymous,
+		"IP":        policy.ip,
+		"user":      policy.user,
+		"API key":   policy.apiKey,
+	} {
+		if !validLimit(limit) {
+			return nil, fmt.Errorf("the %s rate limit needs a positive rps and a burst of at least 1", tier)
+		}
+	}
+
+	for _, entry := range cfg.limiter.routes {
+		route, err := parseRateLimitRoute(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		policy.routes = append(policy.routes, route)
+	}
+
+	return policy, nil
+}
+
+// The parseRateLimitRoute() function parses a single route override.
+func parseRateLimitRoute(entry string) (rateLimitRoute, error) {
+	invalid := fmt.Errorf("invalid rate limit route %q", entry)
+
+	name, value, found := strings.Cut(entry, "=")
+	if !found {
+		return rateLimitRoute{}, invalid
+	}
+
+	method, pattern, found := strings.Cut(name, ":")
+	if !found || method == "" || !strings.HasPrefix(pattern, "/") {
+		return rateLimitRoute{}, invalid
+	}
+
+	route := rateLimitRoute{
+		name:     name,
+		method:   strings.ToUpper(method),
+		segments: strings.Split(pattern, "/"),
+	}
+
+	if value == "exempt" {
+		route.exempt = true
+		return route, nil
+	}
+
+	rps, burst, found := strings.Cut(value, ":")
+	if !found {
+		return rateLimitRoute{}, invalid
+	}
+
+	var err error
+
+	route.limit.Rate, err = strconv.ParseFloat(rps, 64)
+	if err != nil {
+		return rateLimitRoute{}, invalid
+	}
+
+	route.limit.Burst, err = strconv.Atoi(burst)
+	if err != nil || !validLimit(route.limit) {
+		return rateLimitRoute{}, invalid
+	}
+
+	return route, nil
+}
+
+// The validLimit() function reports whether a limit allows any requests at all.
+func validLimit(limit ratelimit.Limit) bool {
+	return limit.Rate > 0 && !math.IsInf(limit.Rate, 1) && limit.Burst >= 1
+}
+
+// The matches() method reports whether the route override applies to the request.
+func (route rateLimitRoute) matches(r *http.Request) bool {
+	if route.method != "*" && route.method != r.Method {
+		return false
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+
+	for i, segment := range route.segments {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+
+		if i >= len(segments) {
+			return false
+		}
+
+		if strings.HasPrefix(segment, ":") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+
+		if segment != segments[i] {
+			return false
+		}
+	}
+
+	return len(segments) == len(route.segments)
+}
+
+// The limitFor() method returns the limit which applies to the request in one of the
+// two passes, and the key that it is counted against. Before authentication, the key
+// is the client's IP address; afterwards, it is their user or API key. Requests which
+// carried credentials but end up anonymous are counted against the anonymous limit in
+// the second pass, as they were only held to the ip limit in the first. If the request
+// isn't limited in the pass (because it is exempt, or has already been counted), it
+// returns false.
+func (app *application) limitFor(r *http.Request, authenticated bool) (string, ratelimit.Limit, bool) {
+	var (
+		key       string
+		limit     ratelimit.Limit
+		anonymous bool
+	)
+
+	ip := realip.FromRequest(r)
+
+	switch {
+	case !authenticated && hasCredentials(r):
+		key = "ip:" + ip
+		limit = app.rateLimits.ip
+	case !authenticated:
+		key = "anonymous:" + ip
+		limit = app.rateLimits.anonymous
+	case app.contextGetAPIKey(r) != 0:
+		key = "apikey:" + strconv.FormatInt(app.contextGetAPIKey(r), 10)
+		limit = app.rateLimits.apiKey
+	case !app.contextGetUser(r).IsAnonymous():
+		key = "user:" + strconv.FormatInt(app.contextGetUser(r).ID, 10)
+		limit = app.rateLimits.user
+	case hasCredentials(r):
+		key = "anonymous:" + ip
+		limit = app.rateLimits.anonymous
+		anonymous = true
+	default:
+		anonymous = true
+	}
+
+	// The first matching route override wins. Before authentication, a route's
+	// requests are counted per IP address whichever limit the request would otherwise
+	// get, so that adding or removing credentials doesn't give a client a second
+	// allowance. Anonymous requests have already been counted against the route then.
+	for _, route := range app.rateLimits.routes {
+		if route.matches(r) {
+			switch {
+			case route.exempt:
+				return "", ratelimit.Limit{}, false
+			case !authenticated:
+				return "route:" + route.name + ":" + ip, route.limit, true
+			case anonymous:
+				return "", ratelimit.Limit{}, false
+			default:
+				return "route:" + route.name + ":" + key, route.limit, true
+			}
+		}
+	}
+
+	if key == "" {
+		return "", ratelimit.Limit{}, false
+	}
+
+	return key, limit, true
+}
+
+// The hasCredentials() function reports whether the request carries an API key or an
+// authentication token, whether or not they turn out to be valid. HTTP Basic
+// credentials don't count, as they only identify OAuth clients and the request is
+// otherwise treated as anonymous.
+func hasCredentials(r *http.Request) bool {
+	if r.Header.Get("X-API-Key") != "" {
+		return true
+	}
+
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	return scheme == "Bearer" || scheme == "ApiKey"
+}
+
+// The setRateLimitHeaders() function describes the caller's limit in the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, so that well-behaved clients can
+// slow down before they are refused. As a request can be counted against more than
+// one limit, the headers describe whichever has the fewest requests remaining.
+func setRateLimitHeaders(w http.ResponseWriter, result ratelimit.Result) {
+	if remaining, err := strconv.Atoi(w.Header().Get("RateLimit-Remaining")); err == nil && remaining <= result.Remaining {
+		return
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+// The ceilSeconds() function rounds a duration up to a whole number of seconds, as
+// used by the RateLimit-Reset and Retry-After headers.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
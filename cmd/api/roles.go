@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string           `json:"name"`
+		Description string           `json:"description"`
+		Permissions data.Permissions `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	data.ValidateRole(v, role)
+
+	// Administrators can only create roles with permissions that they hold themselves.
+	err = app.validateHeldPermissions(v, r, "permissions", role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Roles.Insert(role)
+		if err != nil {
+			return err
+		}
+
+		return log.record("role.create", "role", role.ID, nil, role)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateRoleHandler() changes a role. Every user who holds the role gets its new
+// permissions straight away.
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := app.readRoleIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name        *string          `json:"name"`
+		Description *string          `json:"description"`
+		Permissions data.Permissions `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	before := *role
+
+	if input.Name != nil {
+		role.Name = *input.Name
+	}
+
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	v := validator.New()
+
+	data.ValidateRole(v, role)
+
+	err = app.validateHeldPermissions(v, r, "permissions", role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Roles are shared by every organization, so taking a permission away from a role
+	// mustn't leave any of them without an administrator.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := app.guardLastAdmin(tx, func() error {
+			return tx.Roles.Update(role)
+		})
+		if err != nil {
+			return err
+		}
+
+		return log.record("role.update", "role", role.ID, before, role)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "permissions")
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		role, err := tx.Roles.Get(id)
+		if err != nil {
+			return err
+		}
+
+		err = app.guardLastAdmin(tx, func() error {
+			return tx.Roles.Delete(id)
+		})
+		if err != nil {
+			return err
+		}
+
+		return log.record("role.delete", "role", id, role, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "role")
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID, app.contextGetOrganization(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserRolesHandler() replaces the roles held by a user in the administrator's
+// organization. Direct grants of permissions to the user aren't affected.
+func (app *application) updateUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Roles != nil, "roles", "must be provided")
+	v.Check(validator.Unique(input.Roles), "roles", "must not contain duplicate values")
+
+	allRoles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Check that every role exists, and collect the permissions which they grant, as
+	// administrators can only give users permissions that they hold themselves.
+	var granted data.Permissions
+
+	for _, name := range input.Roles {
+		i := slices.IndexFunc(allRoles, func(role *data.Role) bool { return role.Name == name })
+		if i < 0 {
+			v.AddError("roles", "must only contain existing roles ("+name+" is not one)")
+			continue
+		}
+
+		for _, code := range allRoles[i].Permissions {
+			if !granted.Include(code) {
+				granted = append(granted, code)
+			}
+		}
+	}
+
+	err = app.validateHeldPermissions(v, r, "roles", granted)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	orgID := app.contextGetOrganization(r)
+
+	var roles []*data.Role
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		before, err := tx.Roles.GetAllForUser(user.ID, orgID)
+		if err != nil {
+			return err
+		}
+
+		effective, err := tx.Permissions.GetAllForUser(user.ID, orgID)
+		if err != nil {
+			return err
+		}
+
+		// Make sure that the change doesn't take away the last administrator's admin
+		// access.
+		err = app.guardLastAdmin(tx, func() error {
+			return tx.Roles.SetForUser(user.ID, orgID, input.Roles)
+		})
+		if err != nil {
+			return err
+		}
+
+		roles, err = tx.Roles.GetAllForUser(user.ID, orgID)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("role.assign", "user", user.ID, rolesAudit(orgID, before), rolesAudit(orgID, roles))
+		if err != nil {
+			return err
+		}
+
+		return app.revokeRemovedPermissions(tx, log, user.ID, orgID, effective)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "roles")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readRoleIDParam() helper looks up the role whose ID is given in the URL. If
+// there is no such role, or something goes wrong, it sends an error response and
+// returns false.
+func (app *application) readRoleIDParam(w http.ResponseWriter, r *http.Request) (*data.Role, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return role, true
+}
+
+// The rolesAudit() helper returns the details recorded in the audit log when a user's
+// roles in an organization are changed: the names of the roles that they hold.
+func rolesAudit(orgID int64, roles []*data.Role) map[string]any {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = role.Name
+	}
+
+	return map[string]any{"org_id": orgID, "roles": names}
+}
@@ -24,7 +24,7 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(
 		http.MethodPost,
 		"/v1/movies",
-		app.requirePermission("movies:write", app.createMovieHandler),
+		app.requirePermission("movies:write", app.requireTwoFactor(app.createMovieHandler)),
 	)
 	router.HandlerFunc(
 		http.MethodGet,
@@ -34,31 +34,364 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(
 		http.MethodPost,
 		"/v1/movies/:id",
-		app.requirePermission("movies:write", app.updateMovieHandler),
+		app.requirePermission("movies:write", app.requireTwoFactor(app.updateMovieHandler)),
 	)
 	router.HandlerFunc(
 		http.MethodPatch,
 		"/v1/movies/:id",
-		app.requirePermission("movies:write", app.patchMovieHandler),
+		app.requirePermission("movies:write", app.requireTwoFactor(app.patchMovieHandler)),
 	)
 	router.HandlerFunc(
 		http.MethodDelete,
 		"/v1/movies/:id",
-		app.requirePermission("movies:write", app.deleteMovieHandler),
+		app.requirePermission("movies:write", app.requireTwoFactor(app.deleteMovieHandler)),
 	)
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/me",
+		app.requireAuthenticatedUser(app.showCurrentUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/me/organizations",
+		app.requireAuthenticatedUser(app.listCurrentUserOrganizationsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/users/me",
+		app.requireAuthenticatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.updateCurrentUserHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/users/me",
+		app.requireAuthenticatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.deleteCurrentUserHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/users/me/email",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.updateUserEmailHandler)),
+		),
+	)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email/verified", app.verifyUserEmailHandler)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/me/api-keys",
+		app.requireActivatedUser(app.listAPIKeysHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/users/me/api-keys",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.createAPIKeyHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/me/api-keys/:id",
+		app.requireActivatedUser(app.showAPIKeyHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/users/me/api-keys/:id",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.updateAPIKeyHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/users/me/api-keys/:id",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.deleteAPIKeyHandler)),
+		),
+	)
+
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/users/me/totp",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.createTOTPHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/users/me/totp/confirmed",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.confirmTOTPHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/users/me/totp",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.deleteTOTPHandler)),
+		),
+	)
+
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/users/me/export",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.createDataExportHandler)),
+		),
+	)
+	router.HandlerFunc(http.MethodGet, "/v1/exports/:token", app.showDataExportHandler)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/me/sessions",
+		app.requireAuthenticatedUser(app.listSessionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/users/me/sessions/:id",
+		app.requireAuthenticatedUser(app.requireFirstPartySession(app.deleteSessionHandler)),
+	)
 
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/activation",
+		app.createActivationTokenHandler,
+	)
 	router.HandlerFunc(
 		http.MethodPost,
 		"/v1/tokens/authentication",
 		app.createAuthenticationTokenHandler,
 	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/mfa",
+		app.createMFAAuthenticationTokenHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/magic-link",
+		app.createMagicLinkTokenHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/magic-link/exchange",
+		app.exchangeMagicLinkTokenHandler,
+	)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.createRefreshTokenHandler)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/tokens/authentication",
+		app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/oauth/clients",
+		app.requireActivatedUser(app.listOAuthClientsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/oauth/clients",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.createOAuthClientHandler)),
+		),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/oauth/clients/:id",
+		app.requireActivatedUser(app.requireFirstPartySession(app.deleteOAuthClientHandler)),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/oauth/authorize",
+		app.requireActivatedUser(app.showOAuthAuthorizationHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/oauth/authorize",
+		app.requireActivatedUser(
+			app.denyImpersonation(app.requireFirstPartySession(app.createOAuthAuthorizationHandler)),
+		),
+	)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.createOAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/revoke", app.revokeOAuthTokenHandler)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/users",
+		app.requirePermission("users:admin", app.listUsersHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/users/:id",
+		app.requirePermission("users:admin", app.showUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/admin/users/:id/activated",
+		app.requirePermission("users:admin", app.activateUserByAdminHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/admin/users/:id/deactivated",
+		app.requirePermission("users:admin", app.deactivateUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/users/:id/deactivated",
+		app.requirePermission("users:admin", app.reactivateUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/users/:id/sessions",
+		app.requirePermission("users:admin", app.deleteUserSessionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/admin/users/:id/impersonation",
+		app.requirePermission("users:admin", app.denyImpersonation(app.createImpersonationHandler)),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/users/:id/lockout",
+		app.requirePermission("users:admin", app.deleteUserLockoutHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/permissions",
+		app.requirePermission("permissions:admin", app.listPermissionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/users/:id/permissions",
+		app.requirePermission("permissions:admin", app.showUserPermissionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/admin/users/:id/permissions",
+		app.requirePermission("permissions:admin", app.grantUserPermissionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/users/:id/permissions",
+		app.requirePermission("permissions:admin", app.revokeUserPermissionsHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/users/:id/roles",
+		app.requirePermission("permissions:admin", app.listUserRolesHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/admin/users/:id/roles",
+		app.requirePermission("permissions:admin", app.updateUserRolesHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/users/:id/attributes",
+		app.requirePermission("permissions:admin", app.showUserAttributesHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/admin/users/:id/attributes",
+		app.requirePermission("permissions:admin", app.updateUserAttributesHandler),
+	)
+
+	// Roles are shared by every organization, so changing them needs the
+	// organizations:admin permission.
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/roles",
+		app.requirePermission("permissions:admin", app.listRolesHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/admin/roles",
+		app.requirePermission("organizations:admin", app.createRoleHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/roles/:id",
+		app.requirePermission("permissions:admin", app.showRoleHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/admin/roles/:id",
+		app.requirePermission("organizations:admin", app.updateRoleHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/roles/:id",
+		app.requirePermission("organizations:admin", app.deleteRoleHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/invitations",
+		app.requirePermission("users:admin", app.listInvitationsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/admin/invitations",
+		app.requirePermission("users:admin", app.createInvitationHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/invitations/:id",
+		app.requirePermission("users:admin", app.deleteInvitationHandler),
+	)
+	router.HandlerFunc(http.MethodPost, "/v1/invitations/accepted", app.acceptInvitationHandler)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/organizations",
+		app.requirePermission("organizations:admin", app.listOrganizationsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/admin/organizations",
+		app.requirePermission("organizations:admin", app.createOrganizationHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/admin/organizations/:id/members",
+		app.requirePermission("organizations:admin", app.addOrganizationMemberHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/admin/organizations/:id/members",
+		app.requirePermission("organizations:admin", app.removeOrganizationMemberHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/admin/policy/explain",
+		app.requirePermission("permissions:admin", app.explainPolicyHandler),
+	)
+
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/admin/audit",
+		app.requirePermission("audit:read", app.listAuditEventsHandler),
+	)
+
+	router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
 
 	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
-	// Use the new metrics() middleware at the start of the chain.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// Use the new metrics() middleware at the start of the chain, followed by the
+	// requestID() middleware so that every later log entry can include the ID.
+	// Requests are limited per IP address by rateLimit() before they are
+	// authenticated, and then per user or API key by rateLimitIdentity().
+	return app.metrics(app.requestID(app.recoverPanic(app.enableCORS(
+		app.rateLimit(app.authenticate(app.rateLimitIdentity(router))),
+	))))
 }
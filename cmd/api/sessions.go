@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/chlovec/greenlight/internal/data"
+)
+
+// The listSessionsHandler() returns the authenticated user's active sessions (that is,
+// their unexpired token families), marking the one used to make the request.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetAllSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Signed tokens aren't stored in the database, so if the request was made with one
+	// we identify the current session using the token family in its claims instead.
+	if claims := app.contextGetClaims(r); claims != nil {
+		for _, session := range sessions {
+			session.Current = claims.Family != "" && session.Family == claims.Family
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteSessionHandler() revokes one of the authenticated user's sessions, such as
+// one on a device that has been lost.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Only delete the session if it belongs to the current user. Sessions belonging to
+	// other users are reported as not found, so that their IDs aren't revealed.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		families, err := tx.Tokens.DeleteSessionForUser(user.ID, id)
+		if err != nil {
+			return err
+		}
+
+		err = app.revokeTokenFamilies(tx, families)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, map[string]any{"session_id": id}, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "session successfully revoked"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
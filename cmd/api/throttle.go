@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/ratelimit"
+)
+
+// The throttle type limits how often an event may happen for each key it is given,
+// such as an email address. Unlike the rateLimit() middleware, which limits requests
+// per client, we use this to limit how often we act on behalf of a particular target
+// (for example, how often we send emails to the same address).
+//
+// The limits are kept in the rate limiter's store, so that they are shared by every
+// instance of the API. Each throttle adds its own prefix to the keys, so that it
+// doesn't share limits with the rate limiter or with other throttles. If the store
+// can't be reached, we fall back to limits kept in this instance's memory, rather than
+// not limiting at all.
+type throttle struct {
+	store    ratelimit.Store
+	fallback *ratelimit.MemoryStore
+	logger   *slog.Logger
+	prefix   string
+	limit    ratelimit.Limit
+}
+
+// The newThrottle() function returns a new throttle which keeps its limits in store,
+// with keys starting with prefix, and permits one event every interval, with bursts of
+// up to burst events.
+func newThrottle(
+	store ratelimit.Store,
+	logger *slog.Logger,
+	prefix string,
+	interval time.Duration,
+	burst int,
+) *throttle {
+	return &throttle{
+		store:    store,
+		fallback: ratelimit.NewMemoryStore(),
+		logger:   logger,
+		prefix:   prefix,
+		limit:    ratelimit.Limit{Rate: 1 / interval.Seconds(), Burst: burst},
+	}
+}
+
+// Allow() reports whether an event for the given key may happen now, along with the
+// state of the key's limit. Keys are compared case-insensitively, so
+// "Alice@Example.com" and "alice@example.com" share the same limiter.
+func (t *throttle) Allow(key string) ratelimit.Result {
+	key = t.prefix + strings.ToLower(key)
+
+	result, err := t.store.Allow(context.Background(), key, t.limit)
+	if err != nil {
+		t.logger.Error("throttle store unavailable", "prefix", t.prefix, "error", err.Error())
+
+		// The in-memory store never fails.
+		result, _ = t.fallback.Allow(context.Background(), key, t.limit)
+	}
+
+	return result
+}
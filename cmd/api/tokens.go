@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/jwt"
 	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -33,13 +37,25 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Refuse to check any more passwords from a client IP address which has made too
+	// many failed attempts recently.
+	if !app.loginAllowed(w, r, data.LoginFailureIP, realip.FromRequest(r)) {
+		return
+	}
+
 	// Lookup the user record based on the email address. If no matching user was
-	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
-	// Unauthorized response to the client (we will create this helper in a moment).
+	// found, then we record the failure and call the app.invalidCredentialsResponse()
+	// helper to send a 401 Unauthorized response to the client.
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.recordFailedLogin(r, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -47,31 +63,468 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Likewise, refuse to check any more passwords for an account which has had too
+	// many failed attempts.
+	if !app.loginAllowed(w, r, data.LoginFailureAccount, strconv.FormatInt(user.ID, 10)) {
+		return
+	}
+
 	// Check if the provided password matches the actual password for the user.
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrPasswordHashBusy):
+			app.passwordHashBusyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
-	// helper again and return.
+	// If the passwords don't match, then we record the failure, call the
+	// app.invalidCredentialsResponse() helper again and return.
 	if !match {
+		err = app.recordFailedLogin(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// The password is correct, so forget any earlier failed attempts for the account.
+	err = app.models.LoginFailures.Reset(
+		data.LoginFailureAccount,
+		strconv.FormatInt(user.ID, 10),
+	)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	// If the stored hash was made with bcrypt or with outdated argon2id parameters,
+	// now is our only chance to upgrade it, as we have the plaintext password. If too
+	// many passwords are being hashed right now, we leave it until next time.
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		switch {
+		case errors.Is(err, data.ErrPasswordHashBusy):
+			app.completeLogin(w, r, user)
+			return
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// If the user record changed since we read it, we skip the upgrade and try
+		// again next time, rather than failing the login.
+		err = app.audit(r, func(tx data.Models, log *auditLog) error {
+			log.setActor(user.ID)
+
+			err := tx.Users.Update(user)
+			if err != nil {
+				return err
+			}
+
+			return log.record("user.password_rehash", "user", user.ID, nil, nil)
+		})
+		if err != nil && !errors.Is(err, data.ErrEditConflict) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// The completeLogin() helper finishes logging in a user whose first factor (their
+// password, or a magic link) has been checked. If the user has two-factor
+// authentication enabled, that isn't enough. Instead of an authentication token, we
+// issue a short-lived mfa-pending token, which the client exchanges for an
+// authentication token by sending it to POST /v1/tokens/mfa along with a valid code.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// Deactivated users can't log in, however they prove who they are.
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	mfaEnabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if mfaEnabled {
+		var token *data.Token
+
+		err = app.audit(r, func(tx data.Models, log *auditLog) error {
+			log.setActor(user.ID)
+
+			token, err = tx.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAPending)
+			if err != nil {
+				return err
+			}
+
+			return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{
+			"message":   "a two-factor authentication code is required",
+			"mfa_token": token,
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Otherwise, we start a new token family and issue a short-lived access token
+	// along with a refresh token.
+	env, err := app.issueAuthenticationTokens(r, user, data.NewTokenFamily())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createRefreshTokenHandler() exchanges a refresh token for a new access token and
+// a new refresh token. Each refresh token can only be used once, so the old one stops
+// working once it has been rotated.
+func (app *application) createRefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Mark the refresh token as used. If it had already been used, somebody other than
+	// the legitimate client may have a copy of it, so the whole token family has been
+	// revoked and the user will need to log in again.
+	token, err := app.models.Tokens.Consume(data.ScopeRefresh, input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn(
+				"refresh token reused, token family revoked",
+				"ip", realip.FromRequest(r),
+			)
+
+			// The signed access tokens issued in the family may be in the wrong hands
+			// too.
+			err = app.revokeTokenFamilies(app.models, []string{token.Family})
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env, err := app.issueAuthenticationTokens(r, user, token.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The issueAuthenticationTokens() helper creates a new access token and refresh token
+// for a user in the given token family, recording the client's user agent and IP
+// address so the user can tell their sessions apart. The new tokens are recorded in
+// the audit log. It returns an envelope containing both tokens, ready to be sent to the
+// client.
+func (app *application) issueAuthenticationTokens(
+	r *http.Request,
+	user *data.User,
+	family string,
+) (envelope, error) {
+	userAgent, ip := r.UserAgent(), realip.FromRequest(r)
+
+	var accessToken, refreshToken *data.Token
+
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		log.setActor(user.ID)
+
+		var err error
+
+		if app.config.auth.stateless {
+			accessToken, err = app.newSignedToken(r, user, family)
+		} else {
+			accessToken, err = tx.Tokens.NewSession(
+				user.ID,
+				app.config.auth.accessTokenTTL,
+				data.ScopeAuthentication,
+				family,
+				userAgent,
+				ip,
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		refreshToken, err = tx.Tokens.NewSession(
+			user.ID,
+			app.config.auth.refreshTokenTTL,
+			data.ScopeRefresh,
+			family,
+			userAgent,
+			ip,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("token.create", "token", user.ID, nil, tokenAudit(accessToken))
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.create", "token", user.ID, nil, tokenAudit(refreshToken))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{"authentication_token": accessToken, "refresh_token": refreshToken}, nil
+}
+
+// The newSignedToken() helper creates a signed stateless access token for the user,
+// embedding their activation state, the organization that the token acts in and their
+// current permissions there in its claims. The organization is the one named in the
+// request's X-Organization-ID header if the user belongs to it, and otherwise their
+// default organization. The token isn't stored in the database.
+func (app *application) newSignedToken(r *http.Request, user *data.User, family string) (*data.Token, error) {
+	orgID, err := app.resolveOrganization(r.Header.Get(organizationHeader), user.ID)
+	if errors.Is(err, errInvalidOrganization) || errors.Is(err, errNotOrganizationMember) {
+		orgID, err = app.resolveOrganization("", user.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTokenTTL)
+
+	claims := &jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		ID:          rand.Text(),
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+		Family:      family,
+		Activated:   user.Activated,
+		OrgID:       orgID,
+		Permissions: permissions,
+	}
+
+	plaintext, err := app.signingKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+	}
+
+	return token, nil
+}
+
+// The jwksHandler() publishes the public keys used to verify signed tokens, in JSON
+// Web Key Set format.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if app.signingKeys == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"keys": app.signingKeys.PublicKeys()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAuthenticationTokenHandler() logs the user out of the current session by
+// deleting the authentication token that the request was made with, along with the
+// rest of its token family (including the refresh token). Signed tokens can't be
+// deleted, so we add them to the denylist instead.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.audit(r, func(tx data.Models, log *auditLog) error {
+		var err error
+
+		if claims := app.contextGetClaims(r); claims != nil {
+			err = app.revokeSignedToken(claims)
+			if err == nil && claims.Family != "" {
+				err = tx.Tokens.DeleteAllInFamily(claims.Family)
+			}
+			// Signed tokens issued earlier in the session, before it was last
+			// refreshed, must stop working too.
+			if err == nil && claims.Family != "" {
+				err = app.revokeTokenFamilies(tx, []string{claims.Family})
+			}
+		} else {
+			err = tx.Tokens.DeleteFamily(app.contextGetToken(r))
+		}
+		if err != nil {
+			return err
+		}
+
+		details := map[string]any{"sessions": "current"}
+		return log.record("token.delete", "token", app.contextGetUser(r).ID, details, nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "you have been successfully logged out"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Throttle requests per email address before doing anything else, so that this
+	// endpoint can't be used to flood somebody's inbox (even from many different IP
+	// addresses).
+	if result := app.emailThrottle.Allow("activation:" + input.Email); !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result)
+		return
+	}
+
+	// We send the same response whether or not an email was sent, so that this
+	// endpoint can't be used to find out which email addresses have accounts, or
+	// whether they have been activated.
+	env := envelope{"message": "if the email address belongs to an account which hasn't been activated, an email will be sent to it containing activation instructions"}
+
+	// Try to retrieve the corresponding user record for the email address. Only users
+	// who haven't been activated yet are sent a new token.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err == nil && !user.Activated {
+		// Delete any existing activation tokens for the user, so that only the token
+		// in the latest email can be used.
+		var token *data.Token
+
+		err = app.audit(r, func(tx data.Models, log *auditLog) error {
+			log.setActor(user.ID)
+
+			err := tx.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+			if err != nil {
+				return err
+			}
+
+			// Otherwise, create a new activation token.
+			token, err = tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+			if err != nil {
+				return err
+			}
+
+			return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Email the user with their additional activation token.
+		app.background(func() {
+			data := map[string]any{
+				"activationToken": token.Plaintext,
+			}
+
+			// Since email addresses MAY be case sensitive, notice that we are sending
+			// this email using the address stored in our database for the user --- not
+			// to the input.Email address provided by the client in this request.
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/data"
+	"github.com/chlovec/greenlight/internal/totp"
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// The createTOTPHandler() starts enrolling the user in two-factor authentication. It
+// generates a new secret and returns it (along with an otpauth:// URI which can be
+// shown as a QR code) so the user can add it to their authenticator app. Two-factor
+// authentication isn't enabled until the user confirms a code.
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	user, ok := app.checkCurrentPassword(w, r, v, "password", input.Password)
+	if !ok {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret := totp.GenerateSecret()
+
+	err = app.models.TOTP.InsertPending(user.ID, app.totpKeys.Seal(user.ID, secret))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"totp": map[string]string{
+			"secret": totp.EncodeSecret(secret),
+			"uri":    totp.URI("Greenlight", user.Email, secret),
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmTOTPHandler() completes enrolment. If the code matches the pending secret,
+// two-factor authentication is enabled and a set of recovery codes is returned.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication enrolment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if credential.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := app.verifyTOTPCode(credential, input.Code, true)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "is invalid or has expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var codes []string
+
+	err = app.models.Transaction(func(tx data.Models) error {
+		var err error
+
+		codes, err = tx.TOTP.NewRecoveryCodes(user.ID)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"message":        "two-factor authentication has been enabled",
+		"recovery_codes": codes,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteTOTPHandler() disables two-factor authentication. It requires both the
+// user's password and a current code (or a recovery code).
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	user, ok := app.checkCurrentPassword(w, r, v, "password", input.Password)
+	if !ok {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err = app.verifySecondFactor(v, user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Transaction(func(tx data.Models) error {
+		return tx.TOTP.Delete(user.ID)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "two-factor authentication has been disabled"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createMFAAuthenticationTokenHandler() is the second step of logging in with
+// two-factor authentication enabled. It exchanges the mfa-pending token returned by
+// createAuthenticationTokenHandler(), plus a valid code or recovery code, for an
+// authentication token.
+func (app *application) createMFAAuthenticationTokenHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.MFAToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Limit the number of guesses per user, so that the 6-digit code can't be brute
+	// forced within the lifetime of the mfa-pending token.
+	if result := app.mfaThrottle.Allow(strconv.FormatInt(user.ID, 10)); !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(v, user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// The mfa-pending token has served its purpose, so delete it.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		log.setActor(user.ID)
+
+		err := tx.Tokens.DeleteAllForUser(data.ScopeMFAPending, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, scopeAudit(data.ScopeMFAPending), nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.issueAuthenticationTokens(r, user, data.NewTokenFamily())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The verifySecondFactor() helper checks either a TOTP code or a recovery code for the
+// user (exactly one must be provided, otherwise an error is recorded in the validator).
+// It returns true if the code is valid. A recovery code is used up by this check.
+func (app *application) verifySecondFactor(
+	v *validator.Validator,
+	userID int64,
+	code, recoveryCode string,
+) (bool, error) {
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	v.Check(code == "" || recoveryCode == "", "code", "must not be provided with a recovery code")
+
+	if code != "" {
+		data.ValidateTOTPCode(v, code)
+	}
+
+	if !v.Valid() {
+		return false, nil
+	}
+
+	credential, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if !credential.Confirmed {
+		return false, nil
+	}
+
+	if recoveryCode != "" {
+		err := app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	return app.verifyTOTPCode(credential, code, false)
+}
+
+// The verifyTOTPCode() helper checks a code against a credential, and records its time
+// step so that the same code can't be used again. If confirm is true, the credential
+// is also marked as confirmed.
+func (app *application) verifyTOTPCode(
+	credential *data.TOTP,
+	code string,
+	confirm bool,
+) (bool, error) {
+	secret, err := app.totpKeys.Open(credential.UserID, credential.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), credential.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+
+	err = app.models.TOTP.UseStep(credential.UserID, step, confirm)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/chlovec/greenlight/internal/data"
@@ -30,18 +31,78 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	err = user.Password.Set(input.Password)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrPasswordHashBusy):
+			app.passwordHashBusyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
 	v := validator.New()
 
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+
+	// Reject passwords which are easy to guess or known to attackers.
+	err = app.validateNewPassword(v, input.Password, input.Name, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// Create the user, add them to the default organization with the "movies:read"
+	// permission there, and issue their activation token, all in one transaction
+	// along with the audit events for the changes.
+	var token *data.Token
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		log.setActor(user.ID)
+
+		org, err := tx.Organizations.GetBySlug(data.DefaultOrganizationSlug)
+		if err != nil {
+			return err
+		}
+
+		log.setOrganization(org.ID)
+
+		err = tx.Organizations.AddMember(org.ID, user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Permissions.AddForUser(user.ID, org.ID, "movies:read")
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("user.create", "user", user.ID, nil, user)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("permission.grant", "user", user.ID, nil, permissionsAudit(org.ID, "movies:read"))
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -53,19 +114,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	app.background(func() {
 		data := map[string]any{
 			"activationToken": token.Plaintext,
@@ -120,11 +168,32 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Update the user's activation status.
+	before := *user
 	user.Activated = true
 
 	// Save the updated user record in our database, checking for any edit conflicts in
-	// the same way that we did for our movie records.
-	err = app.models.Users.Update(user)
+	// the same way that we did for our movie records. If everything went successfully,
+	// then we delete all activation tokens for the user.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		log.setActor(user.ID)
+
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("user.activate", "user", user.ID, before, user)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, scopeAudit(data.ScopeActivation), nil)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -135,17 +204,486 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// If everything went successfully, then we delete all activation tokens for the
-	// user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	// Send the updated user details to the client in a JSON response.
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the new email address and the user's current password from the request
+	// body.
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Require the current password, so that somebody who gets hold of an
+	// authentication token can't take over the account by changing its email address.
+	user, ok := app.checkCurrentPassword(w, r, v, "password", input.Password)
+	if !ok {
+		return
+	}
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(
+		!strings.EqualFold(input.Email, user.Email),
+		"email",
+		"must be different from the current email address",
+	)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check up front that the new address isn't already in use. We check again when
+	// the change is confirmed, as another account may claim it in the meantime.
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if result := app.emailThrottle.Allow("email_change:" + input.Email); !result.Allowed {
+		app.rateLimitExceededResponse(w, r, result)
+		return
+	}
+
+	// Record the new address as pending. The user's email address doesn't change
+	// until the new address has been verified.
+	oldEmail := user.Email
+	before := *user
+	user.PendingEmail = &input.Email
+
+	// Replace any outstanding email change tokens, so that only the most recently
+	// requested address can be confirmed.
+	var token *data.Token
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err = tx.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("user.update", "user", user.ID, before, user)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.create", "token", user.ID, nil, tokenAudit(token))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Send the verification token to the new address, and let the old address know
+	// that a change has been requested in case the user didn't ask for it.
+	app.background(func() {
+		data := map[string]any{
+			"emailChangeToken": token.Plaintext,
+			"newEmail":         input.Email,
+		}
+
+		err := app.mailer.Send(input.Email, "email_change_verify.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		err = app.mailer.Send(oldEmail, "email_change_notice.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{
+		"message": "an email will be sent to the new address containing verification instructions",
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) verifyUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the plaintext email change token from the request body.
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Retrieve the user associated with the token. If there is no matching record, or
+	// the user no longer has a pending email address, the token is not valid.
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.PendingEmail == nil {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Swap in the verified address. If another account has claimed the address since
+	// the change was requested, the update will fail with ErrDuplicateEmail.
+	before := *user
+	user.Email = *user.PendingEmail
+	user.PendingEmail = nil
+
+	// Once the change is complete, delete all email change tokens for the user.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		log.setActor(user.ID)
+
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("user.update", "user", user.ID, before, user)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, scopeAudit(data.ScopeEmailChange), nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Send the updated user details to the client in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The showCurrentUserHandler() returns the authenticated user's account, along with the
+// organization that the request acts in and the permissions that they hold there.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Load the full user record, as the user in the request context may only be
+	// partially populated (for example, if the request used a stateless token).
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	orgID := app.contextGetOrganization(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	env := envelope{"user": user, "organization_id": orgID, "permissions": permissions}
+
+	// Let clients know when an administrator is acting as the user, so that they can
+	// make that clear in their interface.
+	if adminID := app.contextGetImpersonator(r); adminID != 0 {
+		env["impersonator_id"] = adminID
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateCurrentUserHandler() lets the authenticated user change their name and
+// password. Changing the password requires the current password, and logs the user out
+// of all of their other sessions.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	var user *data.User
+
+	if input.Password != nil {
+		// Require the current password, so that somebody who gets hold of an
+		// authentication token can't lock the user out of their account.
+		var ok bool
+
+		user, ok = app.checkCurrentPassword(w, r, v, "current_password", input.CurrentPassword)
+		if !ok {
+			return
+		}
+	} else {
+		user, err = app.models.Users.Get(app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	before := *user
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrPasswordHashBusy):
+				app.passwordHashBusyResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.validateNewPassword(v, *input.Password, user.Name, user.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// If the password has changed, anybody else who knew the old one may have logged
+	// in with it, so revoke every session except the one making this request,
+	// including the signed access tokens issued to them.
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		err = log.record("user.update", "user", user.ID, before, user)
+		if err != nil {
+			return err
+		}
+
+		if input.Password == nil {
+			return nil
+		}
+
+		// Password hashes are never recorded, so record the change of password as an
+		// event of its own.
+		err = log.record("user.password_change", "user", user.ID, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		var family string
+		if claims := app.contextGetClaims(r); claims != nil {
+			family = claims.Family
+		}
+
+		families, err := tx.Tokens.DeleteOtherSessionsForUser(user.ID, family, app.contextGetToken(r))
+		if err != nil {
+			return err
+		}
+
+		err = app.revokeTokenFamilies(tx, families)
+		if err != nil {
+			return err
+		}
+
+		return log.record("token.delete", "token", user.ID, map[string]any{"sessions": "other"}, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteCurrentUserHandler() deletes the authenticated user's account. It requires
+// the user's password (and a two-factor authentication code, if they have enabled it).
+// Deleting the user also deletes their tokens, API keys, OAuth clients and permission
+// grants.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	user, ok := app.checkCurrentPassword(w, r, v, "password", input.Password)
+	if !ok {
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mfaEnabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if mfaEnabled {
+		ok, err := app.verifySecondFactor(v, user.ID, input.Code, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		if !ok {
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	err = app.audit(r, func(tx data.Models, log *auditLog) error {
+		// Deleting the user deletes their tokens too, but the signed access tokens
+		// issued to their other sessions have to be revoked explicitly.
+		families, err := tx.Tokens.DeleteAllSessionsForUser(user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = app.revokeTokenFamilies(tx, families)
+		if err != nil {
+			return err
+		}
+
+		err = app.guardLastAdmin(tx, func() error {
+			return tx.Users.Delete(user.ID)
+		})
+		if err != nil {
+			return err
+		}
+
+		return log.record("user.delete", "user", user.ID, user, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errLastAdmin):
+			app.lastAdminResponse(w, r, "user")
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A stateless access token isn't stored in the database, so it must be revoked
+	// explicitly.
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.revokeSignedToken(claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"message": "your account has been deleted"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,312 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// APIKeyPrefix is prepended to every API key, so that keys are easy to recognise (for
+// example, by secret scanners) and can't be confused with other tokens.
+const APIKeyPrefix = "glk_"
+
+// Define an APIKey struct to hold the data for a long-lived API key used by machine
+// clients. Like tokens, only a hash of the key is stored. The plaintext key is only
+// available when the key is first created. The Prefix field holds the first few
+// characters of the key, so that the owner can tell their keys apart.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+	Version     int         `json:"-"`
+}
+
+// Generate() sets a new random plaintext key on the APIKey, along with its prefix and
+// SHA-256 hash.
+func (k *APIKey) Generate() {
+	k.Plaintext = APIKeyPrefix + rand.Text()
+	k.Prefix = k.Plaintext[:len(APIKeyPrefix)+8]
+
+	hash := sha256.Sum256([]byte(k.Plaintext))
+	k.Hash = hash[:]
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Check that the plaintext API key has the expected prefix and length.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(keyPlaintext, APIKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(keyPlaintext) == len(APIKeyPrefix)+26, "key", "must be a valid API key")
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB DBTX
+}
+
+// Insert() generates a new plaintext key for the APIKey and adds it to the api_keys
+// table.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	key.Generate()
+
+	query := `
+        INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at, version`
+
+	args := []any{
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.Hash,
+		pq.Array(key.Permissions),
+		key.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+}
+
+// GetForUser() retrieves a specific API key, so long as it belongs to the given user.
+func (m APIKeyModel) GetForUser(id, userID int64) (*APIKey, error) {
+	query := `
+        SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at, version
+        FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+// GetAllForUser() returns all of a user's API keys, including expired ones, most
+// recently created first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, created_at, user_id, name, prefix, permissions, expiry, last_used_at, version
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.LastUsedAt,
+			&key.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Update() changes the name, permissions and expiry of an API key, using the version
+// number to detect edit conflicts.
+func (m APIKeyModel) Update(key *APIKey) error {
+	query := `
+        UPDATE api_keys
+        SET name = $1, permissions = $2, expiry = $3, version = version + 1
+        WHERE id = $4 AND user_id = $5 AND version = $6
+        RETURNING version`
+
+	args := []any{
+		key.Name,
+		pq.Array(key.Permissions),
+		key.Expiry,
+		key.ID,
+		key.UserID,
+		key.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteForUser() deletes a specific API key, so long as it belongs to the given user.
+func (m APIKeyModel) DeleteForUser(id, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForKey() retrieves an unexpired API key from its plaintext value, along with the
+// user that owns it, and records that the key has been used. To avoid writing to the
+// database on every single request, the key's last use is only updated if it hasn't
+// been recorded in the last minute. If there is no matching key, ErrRecordNotFound is
+// returned.
+func (m APIKeyModel) GetForKey(keyPlaintext string) (*APIKey, *User, error) {
+	query := `
+        SELECT api_keys.id, api_keys.created_at, api_keys.name, api_keys.prefix,
+            api_keys.permissions, api_keys.expiry, api_keys.last_used_at, api_keys.version,
+            users.id, users.created_at, users.name, users.email, users.pending_email,
+            users.password_hash, users.activated, users.deactivated, users.version
+        FROM api_keys
+        INNER JOIN users ON users.id = api_keys.user_id
+        WHERE api_keys.hash = $1
+        AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+        AND NOT users.deactivated`
+
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+	now := time.Now()
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, keyHash[:], now).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.Version,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+
+	if key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-time.Minute)) {
+		query = `
+            UPDATE api_keys
+            SET last_used_at = $1
+            WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)`
+
+		_, err = m.DB.ExecContext(ctx, query, now, key.ID, now.Add(-time.Minute))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key.LastUsedAt = &now
+	}
+
+	return &key, &user, nil
+}
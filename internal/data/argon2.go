@@ -0,0 +1,167 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	// ErrInvalidHash is returned when a stored password hash can't be parsed.
+	ErrInvalidHash = errors.New("invalid password hash")
+
+	// ErrPasswordHashBusy is returned when a password can't be hashed because too many
+	// other hashes are already being computed.
+	ErrPasswordHashBusy = errors.New("too many password hashes in progress")
+)
+
+// Argon2idParams holds the parameters used to derive an argon2id password hash. Memory is
+// measured in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHashParams holds the parameters used to hash new passwords. The defaults
+// follow the recommendations in RFC 9106, and can be changed when the application
+// starts. Existing hashes made with different parameters (or with bcrypt) are still
+// accepted, and are upgraded the next time the user logs in.
+var PasswordHashParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Each argon2id hash needs PasswordHashParams.Memory of RAM while it's computed, so we
+// limit how many can run at once. A hash waits up to passwordHashWait for a free slot,
+// after which ErrPasswordHashBusy is returned.
+var passwordHashSlots = make(chan struct{}, runtime.NumCPU())
+
+const passwordHashWait = time.Second
+
+// SetPasswordHashConcurrency sets the number of argon2id hashes that may be computed at
+// once. It must be called before any passwords are hashed.
+func SetPasswordHashConcurrency(n int) {
+	passwordHashSlots = make(chan struct{}, n)
+}
+
+// The argon2idKey() function derives a key with argon2id once a hashing slot is free.
+func argon2idKey(plaintext string, salt []byte, p Argon2idParams) ([]byte, error) {
+	timer := time.NewTimer(passwordHashWait)
+	defer timer.Stop()
+
+	select {
+	case passwordHashSlots <- struct{}{}:
+	case <-timer.C:
+		return nil, ErrPasswordHashBusy
+	}
+	defer func() { <-passwordHashSlots }()
+
+	key := argon2.IDKey(
+		[]byte(plaintext),
+		salt,
+		p.Iterations,
+		p.Memory,
+		p.Parallelism,
+		p.KeyLength,
+	)
+
+	return key, nil
+}
+
+// The argon2idHash() function hashes a plaintext password with a new random salt,
+// returning the result encoded as a PHC string, like:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<base64 salt>$<base64 hash>
+func argon2idHash(plaintext string, p Argon2idParams) ([]byte, error) {
+	salt := make([]byte, p.SaltLength)
+	rand.Read(salt)
+
+	key, err := argon2idKey(plaintext, salt, p)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.Memory,
+		p.Iterations,
+		p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
+}
+
+// The isArgon2idHash() function reports whether hash is an argon2id PHC string.
+func isArgon2idHash(hash []byte) bool {
+	return strings.HasPrefix(string(hash), "$argon2id$")
+}
+
+// The decodeArgon2idHash() function parses an argon2id PHC string, returning the
+// parameters, salt and key that it contains.
+func decodeArgon2idHash(hash []byte) (Argon2idParams, []byte, []byte, error) {
+	var p Argon2idParams
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+// The argon2idMatches() function checks a plaintext password against an argon2id PHC
+// string, using the parameters recorded in the string.
+func argon2idMatches(plaintext string, hash []byte) (bool, error) {
+	p, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey, err := argon2idKey(plaintext, salt, p)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
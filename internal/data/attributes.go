@@ -0,0 +1,48 @@
+package data
+
+import (
+	"regexp"
+
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// AttributeNameRX matches valid member attribute names, such as "genres" or
+// "assigned_genres".
+var AttributeNameRX = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+// ValidateAttributes checks the attributes of a member of an organization. Each value
+// must be a string, boolean, number, or a list of strings or numbers, so that policy
+// rules can compare it.
+func ValidateAttributes(v *validator.Validator, attributes map[string]any) {
+	v.Check(attributes != nil, "attributes", "must be provided")
+	v.Check(len(attributes) <= 20, "attributes", "must not contain more than 20 attributes")
+
+	for name, value := range attributes {
+		v.Check(len(name) <= 50, "attributes", "must not have names more than 50 bytes long")
+		v.Check(validator.Matches(name, AttributeNameRX), "attributes", "must only have names containing lowercase letters, digits and underscores")
+		v.Check(validAttributeValue(value), "attributes", "must only have strings, booleans, numbers or lists of strings or numbers as values ("+name+" does not)")
+	}
+}
+
+func validAttributeValue(value any) bool {
+	switch value := value.(type) {
+	case string, bool, float64:
+		return true
+	case []any:
+		if len(value) > 100 {
+			return false
+		}
+
+		for _, item := range value {
+			switch item.(type) {
+			case string, float64:
+			default:
+				return false
+			}
+		}
+
+		return true
+	default:
+		return false
+	}
+}
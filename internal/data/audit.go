@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// An AuditEvent records a change made through the API: who made it (and, if they were
+// impersonating the user, which administrator was really responsible), from where, in
+// which request, and what the resource looked like before and after. Before is null
+// for creations, and After is null for deletions.
+type AuditEvent struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	ActorID        int64           `json:"actor_id,omitzero"`
+	ImpersonatorID int64           `json:"impersonator_id,omitzero"`
+	OrgID          int64           `json:"org_id,omitzero"`
+	IP             string          `json:"ip"`
+	RequestID      string          `json:"request_id"`
+	Action         string          `json:"action"`
+	ResourceType   string          `json:"resource_type"`
+	ResourceID     string          `json:"resource_id"`
+	Before         json.RawMessage `json:"before"`
+	After          json.RawMessage `json:"after"`
+}
+
+// AuditFilter holds the conditions used to search the audit log. Zero values match
+// everything.
+type AuditFilter struct {
+	OrgID        int64
+	ActorID      int64
+	Action       string
+	ResourceType string
+	ResourceID   string
+	Since        time.Time
+	Until        time.Time
+}
+
+// Define the AuditModel type.
+type AuditModel struct {
+	DB DBTX
+}
+
+// Insert() adds an event to the audit log. To make sure that a change is never made
+// without being recorded, it should be called on models running in the same
+// transaction as the change.
+func (m AuditModel) Insert(event *AuditEvent) error {
+	query := `
+        INSERT INTO audit_events (actor_id, impersonator_id, org_id, ip, request_id,
+            action, resource_type, resource_id, before, after)
+        VALUES (NULLIF($1::bigint, 0), NULLIF($2::bigint, 0), NULLIF($3::bigint, 0), $4, $5, $6, $7, $8, $9, $10)
+        RETURNING id, created_at`
+
+	args := []any{
+		event.ActorID,
+		event.ImpersonatorID,
+		event.OrgID,
+		event.IP,
+		event.RequestID,
+		event.Action,
+		event.ResourceType,
+		event.ResourceID,
+		nullJSON(event.Before),
+		nullJSON(event.After),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// The nullJSON() function converts an empty JSON document to nil, so that it is stored
+// as NULL.
+func nullJSON(js json.RawMessage) any {
+	if len(js) == 0 {
+		return nil
+	}
+
+	return []byte(js)
+}
+
+// GetAll() returns a page of the audit events which match the filter, along with the
+// pagination metadata.
+func (m AuditModel) GetAll(filter AuditFilter, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, COALESCE(actor_id, 0), COALESCE(impersonator_id, 0),
+            COALESCE(org_id, 0), ip, request_id, action, resource_type, resource_id,
+            COALESCE(before, 'null'), COALESCE(after, 'null')
+        FROM audit_events
+        WHERE (org_id = $1 OR $1 = 0)
+        AND (actor_id = $2 OR $2 = 0)
+        AND (action = $3 OR $3 = '')
+        AND (resource_type = $4 OR $4 = '')
+        AND (resource_id = $5 OR $5 = '')
+        AND (created_at >= $6 OR $6 IS NULL)
+        AND (created_at < $7 OR $7 IS NULL)
+        ORDER BY %s %s, id DESC
+        LIMIT $8 OFFSET $9`, filters.sortColumn(), filters.sortDirection())
+
+	args := []any{
+		filter.OrgID,
+		filter.ActorID,
+		filter.Action,
+		filter.ResourceType,
+		filter.ResourceID,
+		nullTime(filter.Since),
+		nullTime(filter.Until),
+		filters.limit(),
+		filters.offset(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.ImpersonatorID,
+			&event.OrgID,
+			&event.IP,
+			&event.RequestID,
+			&event.Action,
+			&event.ResourceType,
+			&event.ResourceID,
+			&event.Before,
+			&event.After,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
+
+// GetAllForUser() returns every audit event for a request that the user made
+// themselves, oldest first. This covers requests made while impersonating another
+// user, but not those made by an administrator impersonating them, since the IP
+// address recorded for those belongs to the administrator.
+func (m AuditModel) GetAllForUser(userID int64) ([]*AuditEvent, error) {
+	query := `
+        SELECT id, created_at, COALESCE(actor_id, 0), COALESCE(impersonator_id, 0),
+            COALESCE(org_id, 0), ip, request_id, action, resource_type, resource_id,
+            COALESCE(before, 'null'), COALESCE(after, 'null')
+        FROM audit_events
+        WHERE (actor_id = $1 AND impersonator_id IS NULL)
+        OR impersonator_id = $1
+        ORDER BY created_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.ImpersonatorID,
+			&event.OrgID,
+			&event.IP,
+			&event.RequestID,
+			&event.Action,
+			&event.ResourceType,
+			&event.ResourceID,
+			&event.Before,
+			&event.After,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// The nullTime() function converts a zero time to nil, so that it is passed to the
+// database as NULL.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// DeleteOlderThan() removes the audit events recorded before the cutoff, and returns
+// how many were removed.
+func (m AuditModel) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	query := `
+        DELETE FROM audit_events
+        WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// The DenylistModel stores the IDs of signed tokens which have been revoked before
+// their expiry. Signed tokens can't be deleted like the tokens in the tokens table, so
+// instead we remember them until they would have expired anyway. When a whole session
+// is revoked, its token family is stored instead, which revokes every signed token
+// issued in it.
+type DenylistModel struct {
+	DB DBTX
+}
+
+// Insert() adds a token ID to the denylist. Adding the same ID twice is not an error.
+func (m DenylistModel) Insert(jti string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_denylist (jti, expiry)
+        VALUES ($1, $2)
+        ON CONFLICT (jti) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, expiry)
+	return err
+}
+
+// GetAll() returns every unexpired entry in the denylist, as a map of token IDs to
+// their expiry times.
+func (m DenylistModel) GetAll() (map[string]time.Time, error) {
+	query := `
+        SELECT jti, expiry
+        FROM token_denylist
+        WHERE expiry > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]time.Time)
+
+	for rows.Next() {
+		var (
+			jti    string
+			expiry time.Time
+		)
+
+		err := rows.Scan(&jti, &expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[jti] = expiry
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// InsertFamily() adds a token family to the denylist, until expiry (by which time every
+// signed token issued in the family will have expired). If the family is already there,
+// the later expiry is kept.
+func (m DenylistModel) InsertFamily(family string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_family_denylist (family, expiry)
+        VALUES ($1, $2)
+        ON CONFLICT (family) DO UPDATE
+        SET expiry = GREATEST(token_family_denylist.expiry, EXCLUDED.expiry)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family, expiry)
+	return err
+}
+
+// GetAllFamilies() returns every unexpired token family in the denylist, as a map of
+// families to their expiry times.
+func (m DenylistModel) GetAllFamilies() (map[string]time.Time, error) {
+	query := `
+        SELECT family, expiry
+        FROM token_family_denylist
+        WHERE expiry > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	families := make(map[string]time.Time)
+
+	for rows.Next() {
+		var (
+			family string
+			expiry time.Time
+		)
+
+		err := rows.Scan(&family, &expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		families[family] = expiry
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return families, nil
+}
+
+// DeleteExpired() removes the entries for tokens and token families which have
+// expired, since they would be rejected anyway.
+func (m DenylistModel) DeleteExpired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, query := range []string{
+		`DELETE FROM token_denylist WHERE expiry <= $1`,
+		`DELETE FROM token_family_denylist WHERE expiry <= $1`,
+	} {
+		_, err := m.DB.ExecContext(ctx, query, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
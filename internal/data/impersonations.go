@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// An Impersonation records that an administrator was issued a token which lets them
+// act as another user, along with their reason for doing so. These records are kept
+// even after the token expires, so that impersonation can be audited.
+type Impersonation struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	AdminID   int64     `json:"admin_id"`
+	UserID    int64     `json:"user_id"`
+	Reason    string    `json:"reason"`
+	IP        string    `json:"ip"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+func ValidateImpersonation(v *validator.Validator, impersonation *Impersonation) {
+	v.Check(impersonation.Reason != "", "reason", "must be provided")
+	v.Check(len(impersonation.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+
+	v.Check(impersonation.UserID != impersonation.AdminID, "user", "must not be yourself")
+}
+
+// Define the ImpersonationModel type.
+type ImpersonationModel struct {
+	DB DBTX
+}
+
+// Insert() records a new impersonation.
+func (m ImpersonationModel) Insert(impersonation *Impersonation) error {
+	query := `
+        INSERT INTO impersonations (admin_id, user_id, reason, ip, expiry)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	args := []any{
+		impersonation.AdminID,
+		impersonation.UserID,
+		impersonation.Reason,
+		impersonation.IP,
+		impersonation.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&impersonation.ID,
+		&impersonation.CreatedAt,
+	)
+}
+
+// GetAllForUser() returns every impersonation that the user started as an
+// administrator, or that was started against them, oldest first. The IP address is
+// only included for the impersonations that the user started themselves, as for the
+// others it belongs to the administrator.
+func (m ImpersonationModel) GetAllForUser(userID int64) ([]*Impersonation, error) {
+	query := `
+        SELECT id, created_at, COALESCE(admin_id, 0), COALESCE(user_id, 0), reason,
+            CASE WHEN admin_id = $1 THEN ip ELSE '' END, expiry
+        FROM impersonations
+        WHERE admin_id = $1 OR user_id = $1
+        ORDER BY created_at ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	impersonations := []*Impersonation{}
+
+	for rows.Next() {
+		var impersonation Impersonation
+
+		err := rows.Scan(
+			&impersonation.ID,
+			&impersonation.CreatedAt,
+			&impersonation.AdminID,
+			&impersonation.UserID,
+			&impersonation.Reason,
+			&impersonation.IP,
+			&impersonation.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		impersonations = append(impersonations, &impersonation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return impersonations, nil
+}
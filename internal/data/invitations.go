@@ -0,0 +1,234 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// An Invitation lets somebody create an account which is activated straight away, and
+// which belongs to the inviting administrator's organization with exactly the
+// permissions that the administrator chose. Like tokens, only
+// a hash of the invitation token is stored. The plaintext token is only available when
+// the invitation is first created, so that it can be emailed to the invitee.
+type Invitation struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Email       string      `json:"email"`
+	Permissions Permissions `json:"permissions"`
+	InvitedBy   int64       `json:"invited_by,omitzero"`
+	OrgID       int64       `json:"-"`
+	Plaintext   string      `json:"-"`
+	Hash        []byte      `json:"-"`
+	Expiry      time.Time   `json:"expiry"`
+	AcceptedAt  *time.Time  `json:"accepted_at,omitempty"`
+}
+
+// Generate() sets a new random plaintext token on the Invitation, along with its
+// SHA-256 hash.
+func (i *Invitation) Generate() {
+	i.Plaintext = rand.Text()
+
+	hash := sha256.Sum256([]byte(i.Plaintext))
+	i.Hash = hash[:]
+}
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	ValidateEmail(v, invitation.Email)
+
+	v.Check(len(invitation.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// Define the InvitationModel type.
+type InvitationModel struct {
+	DB DBTX
+}
+
+// Insert() generates a new plaintext token for the Invitation and adds it to the
+// invitations table. Any other pending invitations for the same email address to the
+// same organization are revoked, so that only the latest one can be accepted.
+func (m InvitationModel) Insert(invitation *Invitation) error {
+	invitation.Generate()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+        DELETE FROM invitations
+        WHERE email = $1 AND org_id = $2 AND accepted_at IS NULL`
+
+	_, err := m.DB.ExecContext(ctx, query, invitation.Email, invitation.OrgID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+        INSERT INTO invitations (email, permissions, invited_by, hash, expiry, org_id)
+        VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6)
+        RETURNING id, created_at`
+
+	args := []any{
+		invitation.Email,
+		pq.Array(invitation.Permissions),
+		invitation.InvitedBy,
+		invitation.Hash,
+		invitation.Expiry,
+		invitation.OrgID,
+	}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// GetAll() returns every invitation to an organization, newest first, including those
+// which have been accepted or have expired.
+func (m InvitationModel) GetAll(orgID int64) ([]*Invitation, error) {
+	query := `
+        SELECT id, created_at, email, permissions, COALESCE(invited_by, 0), org_id, expiry, accepted_at
+        FROM invitations
+        WHERE org_id = $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.CreatedAt,
+			&invitation.Email,
+			pq.Array(&invitation.Permissions),
+			&invitation.InvitedBy,
+			&invitation.OrgID,
+			&invitation.Expiry,
+			&invitation.AcceptedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// GetPendingForToken() returns the invitation matching a plaintext token, so long as
+// it hasn't expired or been accepted. If there is no such invitation, ErrRecordNotFound
+// is returned.
+func (m InvitationModel) GetPendingForToken(tokenPlaintext string) (*Invitation, error) {
+	query := `
+        SELECT id, created_at, email, permissions, COALESCE(invited_by, 0), org_id, expiry, accepted_at
+        FROM invitations
+        WHERE hash = $1 AND expiry > $2 AND accepted_at IS NULL`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	invitation := Invitation{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, invitation.Hash, time.Now()).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		pq.Array(&invitation.Permissions),
+		&invitation.InvitedBy,
+		&invitation.OrgID,
+		&invitation.Expiry,
+		&invitation.AcceptedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// MarkAccepted() records that an invitation has been accepted, so that it can't be
+// used again.
+func (m InvitationModel) MarkAccepted(invitation *Invitation) error {
+	query := `
+        UPDATE invitations
+        SET accepted_at = $1
+        WHERE id = $2 AND accepted_at IS NULL
+        RETURNING accepted_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, time.Now(), invitation.ID).Scan(&invitation.AcceptedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeletePending() revokes an invitation to an organization which hasn't been accepted
+// yet, and returns it. If there is no such invitation, ErrRecordNotFound is returned.
+func (m InvitationModel) DeletePending(orgID, id int64) (*Invitation, error) {
+	query := `
+        DELETE FROM invitations
+        WHERE id = $1 AND org_id = $2 AND accepted_at IS NULL
+        RETURNING id, created_at, email, permissions, COALESCE(invited_by, 0), org_id, expiry, accepted_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invitation Invitation
+
+	err := m.DB.QueryRowContext(ctx, query, id, orgID).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		pq.Array(&invitation.Permissions),
+		&invitation.InvitedBy,
+		&invitation.OrgID,
+		&invitation.Expiry,
+		&invitation.AcceptedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
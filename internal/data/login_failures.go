@@ -0,0 +1,129 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Define constants for the kinds of subject that we track failed logins for.
+const (
+	LoginFailureAccount = "account"
+	LoginFailureIP      = "ip"
+)
+
+// A LoginFailure records the recent failed login attempts for a subject (a user
+// account, identified by its ID, or a client IP address), along with the time until
+// which further attempts are blocked, if any.
+type LoginFailure struct {
+	Kind          string
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// Define the LoginFailureModel type.
+type LoginFailureModel struct {
+	DB DBTX
+}
+
+// GetLocked() returns the failure record for a subject, so long as it is currently
+// locked. If it isn't, ErrRecordNotFound is returned.
+func (m LoginFailureModel) GetLocked(kind, subject string) (*LoginFailure, error) {
+	query := `
+        SELECT kind, subject, failures, last_failure_at, locked_until
+        FROM login_failures
+        WHERE kind = $1 AND subject = $2 AND locked_until > $3`
+
+	var failure LoginFailure
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, kind, subject, time.Now()).Scan(
+		&failure.Kind,
+		&failure.Subject,
+		&failure.Failures,
+		&failure.LastFailureAt,
+		&failure.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &failure, nil
+}
+
+// Record() records a failed login attempt for a subject and returns the updated record.
+// Failures are only counted within the given window: if the previous failure was longer
+// ago than that, the count starts again from one.
+func (m LoginFailureModel) Record(
+	kind, subject string,
+	window time.Duration,
+) (*LoginFailure, error) {
+	query := `
+        INSERT INTO login_failures (kind, subject, failures, last_failure_at)
+        VALUES ($1, $2, 1, $3)
+        ON CONFLICT (kind, subject) DO UPDATE
+        SET failures = CASE
+                WHEN login_failures.last_failure_at < $4 THEN 1
+                ELSE login_failures.failures + 1
+            END,
+            last_failure_at = $3
+        RETURNING failures, last_failure_at, locked_until`
+
+	now := time.Now()
+
+	failure := LoginFailure{
+		Kind:    kind,
+		Subject: subject,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, kind, subject, now, now.Add(-window)).Scan(
+		&failure.Failures,
+		&failure.LastFailureAt,
+		&failure.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+// Lock() blocks further login attempts for a subject until the given time.
+func (m LoginFailureModel) Lock(kind, subject string, until time.Time) error {
+	query := `
+        UPDATE login_failures
+        SET locked_until = $1
+        WHERE kind = $2 AND subject = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, until, kind, subject)
+	return err
+}
+
+// Reset() forgets the failed login attempts for a subject, lifting any lock.
+func (m LoginFailureModel) Reset(kind, subject string) error {
+	query := `
+        DELETE FROM login_failures
+        WHERE kind = $1 AND subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, kind, subject)
+	return err
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
@@ -10,18 +11,83 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX is the set of database methods used by the models. It is implemented by both
+// *sql.DB and *sql.Tx, so that the same models can run their queries either directly
+// or as part of a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	APIKeys        APIKeyModel
+	Audit          AuditModel
+	Denylist       DenylistModel
+	Impersonations ImpersonationModel
+	Invitations    InvitationModel
+	LoginFailures  LoginFailureModel
+	Movies         MovieModel
+	OAuthClients   OAuthClientModel
+	OAuthCodes     OAuthCodeModel
+	Organizations  OrganizationModel
+	Permissions    PermissionModel
+	Roles          RoleModel
+	TOTP           TOTPModel
+	Tokens         TokenModel
+	Users          UserModel
+
+	// db is the connection pool that transactions are started on. It is nil for
+	// models which are already running in a transaction.
+	db *sql.DB
 }
 
 func NewModels(db *sql.DB) Models {
+	models := newModels(db)
+	models.db = db
+	return models
+}
+
+func newModels(db DBTX) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		APIKeys:        APIKeyModel{DB: db},
+		Audit:          AuditModel{DB: db},
+		Denylist:       DenylistModel{DB: db},
+		Impersonations: ImpersonationModel{DB: db},
+		Invitations:    InvitationModel{DB: db},
+		LoginFailures:  LoginFailureModel{DB: db},
+		Movies:         MovieModel{DB: db},
+		OAuthClients:   OAuthClientModel{DB: db},
+		OAuthCodes:     OAuthCodeModel{DB: db},
+		Organizations:  OrganizationModel{DB: db},
+		Roles:          RoleModel{DB: db},
+		TOTP:           TOTPModel{DB: db},
+		Tokens:         TokenModel{DB: db},
+		Users:          UserModel{DB: db},
+		Permissions:    PermissionModel{DB: db},
 	}
 }
+
+// Transaction() calls fn with a copy of the models whose queries all run in a single
+// database transaction. The transaction is committed if fn returns nil, and rolled
+// back otherwise, in which case the error from fn is returned unchanged. Calling
+// Transaction() on models which are already in a transaction just calls fn with them,
+// so that the work becomes part of the outer transaction.
+func (m Models) Transaction(fn func(tx Models) error) error {
+	if m.db == nil {
+		return fn(m)
+	}
+
+	tx, err := m.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(newModels(tx))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
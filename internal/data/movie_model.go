@@ -11,31 +11,37 @@ import (
 )
 
 type MovieModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
-// Method for fetching a specific movie record.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// Method for fetching a specific movie record from an organization's catalog. Movies
+// in other organizations' catalogs are treated as if they don't exist.
+func (m MovieModel) Get(orgID, id int64) (*Movie, error) {
 	// SQL query for retrieving the movie data
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, genres, COALESCE(created_by, 0), org_id, version
 		FROM movies
-		WHERE id = $1
+		WHERE id = $1 AND org_id = $2
 	`
 
 	// Declare a movie struct to hold the data returned by the query.
 	var movie Movie
 
-	// Execute the query using QueryRow() method, passing in the
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Execute the query using QueryRowContext() method, passing in the
 	// provided id value as a placeholder parameter, and scan the
 	// response data into the fields of the movie struct.
-	err := m.DB.QueryRow(query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, orgID).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.CreatedBy,
+		&movie.OrgID,
 		&movie.Version,
 	)
 
@@ -52,16 +58,21 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// Method for inserting a new movie record in the movies table.
+// Method for inserting a new movie record in the movies table, in the catalog of the
+// movie's organization.
 func (m MovieModel) Insert(movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, created_by, org_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6)
 		RETURNING id, created_at, version
 	`
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
-	return m.DB.QueryRow(query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy, movie.OrgID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
 // Method for updating a specific movie record in the movies table.
@@ -73,7 +84,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		WHERE id = $5 AND version = $6 AND org_id = $7
 		RETURNING version
 	`
 	args := []any{
@@ -83,11 +94,15 @@ func (m MovieModel) Update(movie *Movie) error {
 		pq.Array(movie.Genres),
 		movie.ID,
 		movie.Version,
+		movie.OrgID,
 	}
 
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the movie struct
-	err := m.DB.QueryRow(query, args...).Scan(&movie.Version)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Use the QueryRowContext() method to execute the query, passing in the args slice
+	// as a variadic parameter and scanning the new version value into the movie struct
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil && errors.Is(err, sql.ErrNoRows) {
 		return ErrEditConflict
 	}
@@ -95,14 +110,17 @@ func (m MovieModel) Update(movie *Movie) error {
 	return err
 }
 
-// Method for deleting a specific movie record.
-func (m MovieModel) Delete(id int64) error {
-	query := `DELETE FROM movies WHERE id = $1`
+// Method for deleting a specific movie record from an organization's catalog.
+func (m MovieModel) Delete(orgID, id int64) error {
+	query := `DELETE FROM movies WHERE id = $1 AND org_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	// Execute SQL query using the Exec() method, passing in the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result
-	// value
-	result, err := m.DB.Exec(query, id)
+	// Execute SQL query using the ExecContext() method, passing in the id and orgID
+	// variables as the values for the placeholder parameters. The ExecContext() method
+	// returns a sql.Result value
+	result, err := m.DB.ExecContext(ctx, query, id, orgID)
 	if err != nil {
 		return err
 	}
@@ -119,22 +137,26 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-// Method for fetching a specific movie record.
+// Method for fetching the movie records in an organization's catalog.
 func (m MovieModel) GetAll(
+	orgID int64,
 	title string,
 	genres []string,
+	ownerID int64,
 	filters Filters,
 ) ([]*Movie, Metadata, error) {
 	// Add an ORDER BY clause and interpolate the sort column and direction. Importantly
 	// notice that we also include a secondary sort on the movie ID to ensure a
 	// consistent ordering.
 	query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, COALESCE(created_by, 0), org_id, version
         FROM movies
         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
         AND (genres @> $2 OR $2 = '{}')     
+        AND (created_by = $3 OR $3 = 0)
+        AND org_id = $6
         ORDER BY %s %s, id ASC
-		Limit $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		Limit $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -143,7 +165,7 @@ func (m MovieModel) GetAll(
 	// values for the placeholders in a slice. Notice here how we call the limit() and
 	// offset() methods on the Filters struct to get the appropriate values for the
 	// LIMIT and OFFSET clauses.
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{title, pq.Array(genres), ownerID, filters.limit(), filters.offset(), orgID}
 
 	// And then pass the args slice to QueryContext() as a variadic parameter.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
@@ -174,6 +196,8 @@ func (m MovieModel) GetAll(
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.OrgID,
 			&movie.Version,
 		)
 		if err != nil {
@@ -194,3 +218,51 @@ func (m MovieModel) GetAll(
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	return movies, metadata, nil
 }
+
+// Method for fetching every movie that a user added, in any organization's catalog,
+// oldest first.
+func (m MovieModel) GetAllCreatedBy(userID int64) ([]*Movie, error) {
+	query := `
+		SELECT id, created_at, title, year, runtime, genres, COALESCE(created_by, 0), org_id, version
+		FROM movies
+		WHERE created_by = $1
+		ORDER BY created_at ASC, id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.OrgID,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
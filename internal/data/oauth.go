@@ -0,0 +1,366 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// OAuthClientSecretPrefix is prepended to every OAuth client secret, so that secrets
+// are easy to recognise and can't be confused with other tokens.
+const OAuthClientSecretPrefix = "gls_"
+
+// CodeVerifierRX matches a PKCE code verifier, as described in RFC 7636 section 4.1.
+var CodeVerifierRX = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// Define an OAuthClient struct to hold the data for a third-party application which
+// can act on behalf of our users. Confidential clients (those which can keep a secret,
+// such as server-side applications) are issued a client secret. Public clients, such
+// as mobile apps, aren't, and rely on PKCE alone. Like API keys, only a hash of the
+// secret is stored. The Scopes field holds the permission codes that the client may
+// request.
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UserID       int64       `json:"-"`
+	ClientID     string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	Confidential bool        `json:"confidential"`
+}
+
+// Generate() sets a new random client ID on the OAuthClient and, for confidential
+// clients, a new plaintext secret along with its SHA-256 hash.
+func (c *OAuthClient) Generate() {
+	c.ClientID = rand.Text()
+
+	if c.Confidential {
+		c.Secret = OAuthClientSecretPrefix + rand.Text()
+
+		hash := sha256.Sum256([]byte(c.Secret))
+		c.SecretHash = hash[:]
+	}
+}
+
+// SecretMatches() reports whether the plaintext secret matches the client's secret.
+// It always returns false for public clients.
+func (c *OAuthClient) SecretMatches(secretPlaintext string) bool {
+	if !c.Confidential {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(secretPlaintext))
+
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	v.Check(
+		validator.Unique(client.RedirectURIs),
+		"redirect_uris",
+		"must not contain duplicate values",
+	)
+
+	for _, uri := range client.RedirectURIs {
+		v.Check(
+			validRedirectURI(uri),
+			"redirect_uris",
+			"must only contain absolute https URIs (or http URIs for localhost)",
+		)
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+// The validRedirectURI() function reports whether uri is suitable for use as a redirect
+// URI. It must be absolute, without a fragment, and use https unless it points at the
+// loopback interface (which native apps use to receive the redirect).
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" {
+			return true
+		}
+
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	default:
+		return false
+	}
+}
+
+// Define the OAuthClientModel type.
+type OAuthClientModel struct {
+	DB DBTX
+}
+
+// Insert() generates a new client ID (and secret, for confidential clients) for the
+// OAuthClient and adds it to the oauth_clients table.
+func (m OAuthClientModel) Insert(client *OAuthClient) error {
+	client.Generate()
+
+	query := `
+        INSERT INTO oauth_clients (user_id, client_id, secret_hash, name, redirect_uris, scopes)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at`
+
+	args := []any{
+		client.UserID,
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.Scopes),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+// GetByClientID() retrieves the client with the given (public) client ID.
+func (m OAuthClientModel) GetByClientID(clientID string) (*OAuthClient, error) {
+	query := `
+        SELECT id, created_at, user_id, client_id, secret_hash, name, redirect_uris, scopes
+        FROM oauth_clients
+        WHERE client_id = $1`
+
+	var client OAuthClient
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, clientID).Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.UserID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&client.Scopes),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	client.Confidential = client.SecretHash != nil
+
+	return &client, nil
+}
+
+// GetAllForUser() returns all of the clients registered by a user, most recently
+// created first.
+func (m OAuthClientModel) GetAllForUser(userID int64) ([]*OAuthClient, error) {
+	query := `
+        SELECT id, created_at, user_id, client_id, secret_hash IS NOT NULL, name, redirect_uris, scopes
+        FROM oauth_clients
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+
+	for rows.Next() {
+		var client OAuthClient
+
+		err := rows.Scan(
+			&client.ID,
+			&client.CreatedAt,
+			&client.UserID,
+			&client.ClientID,
+			&client.Confidential,
+			&client.Name,
+			pq.Array(&client.RedirectURIs),
+			pq.Array(&client.Scopes),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// DeleteForUser() deletes a specific client, so long as it was registered by the given
+// user. Any authorization codes and tokens issued to the client are deleted with it.
+func (m OAuthClientModel) DeleteForUser(id, userID int64) error {
+	query := `
+        DELETE FROM oauth_clients
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Define an OAuthCode struct to hold the data for an authorization code, which a user
+// grants to a client on the consent screen and the client then exchanges for tokens.
+// The code is bound to the client, the redirect URI and the PKCE code challenge that
+// were used to request it. RedirectURI is empty if the request didn't name one (and the
+// client's only registered URI was used).
+type OAuthCode struct {
+	Plaintext     string
+	Hash          []byte
+	ClientID      int64
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// VerifyCodeVerifier() reports whether the PKCE code verifier matches the code
+// challenge, using the S256 method.
+func (c *OAuthCode) VerifyCodeVerifier(verifier string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+// Check that the PKCE code challenge looks like a base64url-encoded SHA-256 hash.
+func ValidateCodeChallenge(v *validator.Validator, challenge, method string) {
+	v.Check(challenge != "", "code_challenge", "must be provided")
+	v.Check(len(challenge) == 43, "code_challenge", "must be 43 bytes long")
+	v.Check(method == "S256", "code_challenge_method", "must be S256")
+}
+
+// Define the OAuthCodeModel type.
+type OAuthCodeModel struct {
+	DB DBTX
+}
+
+// New() generates a new plaintext authorization code, which expires after the given
+// ttl, and adds it to the oauth_codes table.
+func (m OAuthCodeModel) New(code *OAuthCode, ttl time.Duration) error {
+	code.Plaintext = rand.Text()
+	code.Expiry = time.Now().Add(ttl)
+
+	hash := sha256.Sum256([]byte(code.Plaintext))
+	code.Hash = hash[:]
+
+	query := `
+        INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []any{
+		code.Hash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		pq.Array(code.Scopes),
+		code.CodeChallenge,
+		code.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes an authorization code and returns it, so that each code can only
+// be exchanged once. If there is no such unexpired code, ErrRecordNotFound is returned.
+func (m OAuthCodeModel) Consume(codePlaintext string) (*OAuthCode, error) {
+	query := `
+        DELETE FROM oauth_codes
+        WHERE hash = $1
+        RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	hash := sha256.Sum256([]byte(codePlaintext))
+
+	code := OAuthCode{
+		Plaintext: codePlaintext,
+		Hash:      hash[:],
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, code.Hash).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array(&code.Scopes),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &code, nil
+}
@@ -0,0 +1,331 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/validator"
+)
+
+// DefaultOrganizationSlug identifies the organization which existing data was moved
+// into when organizations were introduced, and which new users join when they sign up.
+const DefaultOrganizationSlug = "default"
+
+// ErrDuplicateSlug is returned when an organization is given a slug which is already
+// in use.
+var ErrDuplicateSlug = errors.New("duplicate slug")
+
+// SlugRX matches valid organization slugs, such as "acme" or "acme-films".
+var SlugRX = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// An Organization is an independent catalog of movies, with its own members. Users can
+// belong to any number of organizations, and the permissions and roles that they hold
+// in one don't apply in any other.
+type Organization struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	Version   int       `json:"version"`
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "must be provided")
+	v.Check(len(org.Name) <= 200, "name", "must not be more than 200 bytes long")
+
+	v.Check(org.Slug != "", "slug", "must be provided")
+	v.Check(len(org.Slug) <= 50, "slug", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(org.Slug, SlugRX), "slug", "must only contain lowercase letters, digits and hyphens")
+}
+
+// Define the OrganizationModel type.
+type OrganizationModel struct {
+	DB DBTX
+}
+
+// Insert() adds a new organization, which has no members to begin with.
+func (m OrganizationModel) Insert(org *Organization) error {
+	query := `
+        INSERT INTO organizations (name, slug)
+        VALUES ($1, $2)
+        RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, org.Name, org.Slug).Scan(&org.ID, &org.CreatedAt, &org.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "organizations_slug_key"`:
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get() returns a specific organization.
+func (m OrganizationModel) Get(id int64) (*Organization, error) {
+	query := `
+        SELECT id, created_at, name, slug, version
+        FROM organizations
+        WHERE id = $1`
+
+	return m.getOne(query, id)
+}
+
+// GetBySlug() returns the organization with the given slug.
+func (m OrganizationModel) GetBySlug(slug string) (*Organization, error) {
+	query := `
+        SELECT id, created_at, name, slug, version
+        FROM organizations
+        WHERE slug = $1`
+
+	return m.getOne(query, slug)
+}
+
+// The getOne() helper runs a query which returns a single organization.
+func (m OrganizationModel) getOne(query string, args ...any) (*Organization, error) {
+	var org Organization
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&org.ID,
+		&org.CreatedAt,
+		&org.Name,
+		&org.Slug,
+		&org.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &org, nil
+}
+
+// GetAll() returns every organization, ordered by name.
+func (m OrganizationModel) GetAll() ([]*Organization, error) {
+	query := `
+        SELECT id, created_at, name, slug, version
+        FROM organizations
+        ORDER BY name, id`
+
+	return m.getMany(query)
+}
+
+// GetAllForUser() returns the organizations that a user belongs to, in the order that
+// they joined them.
+func (m OrganizationModel) GetAllForUser(userID int64) ([]*Organization, error) {
+	query := `
+        SELECT organizations.id, organizations.created_at, organizations.name,
+            organizations.slug, organizations.version
+        FROM organizations
+        INNER JOIN organizations_users ON organizations_users.org_id = organizations.id
+        WHERE organizations_users.user_id = $1
+        ORDER BY organizations_users.created_at, organizations.id`
+
+	return m.getMany(query, userID)
+}
+
+// The getMany() helper runs a query which returns a list of organizations.
+func (m OrganizationModel) getMany(query string, args ...any) ([]*Organization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*Organization{}
+
+	for rows.Next() {
+		var org Organization
+
+		err := rows.Scan(
+			&org.ID,
+			&org.CreatedAt,
+			&org.Name,
+			&org.Slug,
+			&org.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		orgs = append(orgs, &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orgs, nil
+}
+
+// GetDefaultForUser() returns the ID of the organization that a user's requests apply
+// to when they don't choose one: the first organization that they joined. If the user
+// doesn't belong to any organization, ErrRecordNotFound is returned.
+func (m OrganizationModel) GetDefaultForUser(userID int64) (int64, error) {
+	query := `
+        SELECT org_id
+        FROM organizations_users
+        WHERE user_id = $1
+        ORDER BY created_at, org_id
+        LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var orgID int64
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&orgID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return orgID, nil
+}
+
+// IsMember() reports whether a user belongs to an organization.
+func (m OrganizationModel) IsMember(orgID, userID int64) (bool, error) {
+	query := `
+        SELECT EXISTS (
+            SELECT 1 FROM organizations_users WHERE org_id = $1 AND user_id = $2
+        )`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var member bool
+
+	err := m.DB.QueryRowContext(ctx, query, orgID, userID).Scan(&member)
+	return member, err
+}
+
+// AddMember() adds a user to an organization. Adding a user who is already a member
+// does nothing.
+func (m OrganizationModel) AddMember(orgID, userID int64) error {
+	query := `
+        INSERT INTO organizations_users (org_id, user_id)
+        VALUES ($1, $2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, orgID, userID)
+	return err
+}
+
+// RemoveMember() removes a user from an organization, along with the permissions and
+// roles that they held in it. If the user isn't a member, ErrRecordNotFound is
+// returned.
+func (m OrganizationModel) RemoveMember(orgID, userID int64) error {
+	query := `
+        DELETE FROM organizations_users
+        WHERE org_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetMemberAttributes() returns the attributes of a member of an organization. If the
+// user isn't a member, ErrRecordNotFound is returned.
+func (m OrganizationModel) GetMemberAttributes(orgID, userID int64) (map[string]any, error) {
+	query := `
+        SELECT attributes
+        FROM organizations_users
+        WHERE org_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var js []byte
+
+	err := m.DB.QueryRowContext(ctx, query, orgID, userID).Scan(&js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	attributes := map[string]any{}
+
+	err = json.Unmarshal(js, &attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return attributes, nil
+}
+
+// SetMemberAttributes() replaces the attributes of a member of an organization. If the
+// user isn't a member, ErrRecordNotFound is returned.
+func (m OrganizationModel) SetMemberAttributes(orgID, userID int64, attributes map[string]any) error {
+	js, err := json.Marshal(attributes)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        UPDATE organizations_users
+        SET attributes = $3
+        WHERE org_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, orgID, userID, string(js))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"slices"
 	"time"
 
@@ -19,27 +18,100 @@ func (p Permissions) Include(code string) bool {
 	return slices.Contains(p, code)
 }
 
+// Intersect() returns the permission codes which appear in both p and other.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	permissions := Permissions{}
+
+	for _, code := range p {
+		if other.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
-// The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// The GetAllForUser() method returns all permission codes for a specific user in an
+// organization in a Permissions slice. These are the user's effective permissions:
+// those granted to them directly, along with those granted by any of their roles.
+func (m PermissionModel) GetAllForUser(userID, orgID int64) (Permissions, error) {
 	query := `
         SELECT permissions.code
         FROM permissions
         INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-        INNER JOIN users ON users_permissions.user_id = users.id
-        WHERE users.id = $1`
+        WHERE users_permissions.user_id = $1 AND users_permissions.org_id = $2
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+        INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+        WHERE users_roles.user_id = $1 AND users_roles.org_id = $2
+        ORDER BY code`
+
+	return m.queryCodes(query, userID, orgID)
+}
+
+// HeldInAnyOrganization() reports whether a user holds a permission (directly or
+// through a role) in at least one organization.
+func (m PermissionModel) HeldInAnyOrganization(userID int64, code string) (bool, error) {
+	query := `
+        SELECT EXISTS (
+            SELECT 1
+            FROM users_permissions
+            INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+            WHERE users_permissions.user_id = $1 AND permissions.code = $2
+            UNION ALL
+            SELECT 1
+            FROM users_roles
+            INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+            INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+            WHERE users_roles.user_id = $1 AND permissions.code = $2
+        )`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	var held bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID, code).Scan(&held)
+	return held, err
+}
+
+// GetAll() returns every permission code that exists.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+        SELECT code
+        FROM permissions
+        ORDER BY code`
+
+	return m.queryCodes(query)
+}
+
+// GetDirectForUser() returns the permission codes granted to a specific user directly
+// in an organization, leaving out those which they only hold through their roles.
+func (m PermissionModel) GetDirectForUser(userID, orgID int64) (Permissions, error) {
+	query := `
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+        WHERE users_permissions.user_id = $1 AND users_permissions.org_id = $2
+        ORDER BY permissions.code`
+
+	return m.queryCodes(query, userID, orgID)
+}
+
+// The queryCodes() helper runs a query which returns a single column of permission
+// codes.
+func (m PermissionModel) queryCodes(query string, args ...any) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -64,17 +136,99 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// Add the provided permission codes for a specific user. Notice that we're using a
-// variadic parameter for the codes so that we can assign multiple permissions in a
-// single call.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// Add the provided permission codes for a specific user in an organization, which
+// they must be a member of. Notice that we're using a variadic parameter for the codes
+// so that we can assign multiple permissions in a single call. Codes which the user
+// already holds are ignored.
+func (m PermissionModel) AddForUser(userID, orgID int64, codes ...string) error {
 	query := `
-        INSERT INTO users_permissions
-        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+        INSERT INTO users_permissions (user_id, org_id, permission_id)
+        SELECT $1, $2, permissions.id FROM permissions WHERE permissions.code = ANY($3)
+        ON CONFLICT DO NOTHING`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	_, err := m.DB.ExecContext(ctx, query, userID, orgID, pq.Array(codes))
 	return err
 }
+
+// RemoveForUser() revokes the provided permission codes from a specific user in an
+// organization. Only direct grants are removed, so the user keeps any of the
+// permissions which they hold through their roles.
+func (m PermissionModel) RemoveForUser(userID, orgID int64, codes ...string) error {
+	query := `
+        DELETE FROM users_permissions
+        WHERE user_id = $1 AND org_id = $2
+        AND permission_id IN (SELECT id FROM permissions WHERE code = ANY($3))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, orgID, pq.Array(codes))
+	return err
+}
+
+// LockHolders() takes a lock, held until the end of the current transaction, which
+// serializes changes that may take permissions away from users. It must be called on
+// models running in a transaction, so that a change can check who is left holding a
+// permission without a concurrent change invalidating the answer.
+func (m PermissionModel) LockHolders() error {
+	query := `SELECT pg_advisory_xact_lock(hashtext('greenlight:permission_holders'))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
+
+// GetOrganizationsWithHolders() returns the IDs of the organizations in which at least
+// one user who hasn't been deactivated holds the permission, directly or through a
+// role.
+func (m PermissionModel) GetOrganizationsWithHolders(code string) ([]int64, error) {
+	query := `
+        SELECT DISTINCT holders.org_id
+        FROM (
+            SELECT users_permissions.user_id, users_permissions.org_id
+            FROM users_permissions
+            INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+            WHERE permissions.code = $1
+            UNION
+            SELECT users_roles.user_id, users_roles.org_id
+            FROM users_roles
+            INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+            INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+            WHERE permissions.code = $1
+        ) AS holders
+        INNER JOIN users ON users.id = holders.user_id
+        WHERE NOT users.deactivated
+        ORDER BY holders.org_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgIDs []int64
+
+	for rows.Next() {
+		var orgID int64
+
+		err := rows.Scan(&orgID)
+		if err != nil {
+			return nil, err
+		}
+
+		orgIDs = append(orgIDs, orgID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orgIDs, nil
+}
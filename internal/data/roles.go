@@ -0,0 +1,291 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrDuplicateRoleName is returned when a role is given a name which is already in
+// use.
+var ErrDuplicateRoleName = errors.New("duplicate role name")
+
+// RoleNameRX matches valid role names, such as "editor" or "support-staff".
+var RoleNameRX = regexp.MustCompile("^[a-z0-9][a-z0-9_-]*$")
+
+// A Role groups together a set of permissions, so that they can be granted to users
+// all at once. A user's effective permissions are those granted to them directly, plus
+// those granted by each of their roles.
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	Version     int         `json:"version"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 50, "name", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(role.Name, RoleNameRX), "name", "must only contain lowercase letters, digits, hyphens and underscores")
+
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB DBTX
+}
+
+// Insert() adds a new role, along with its permissions. Both are added in a single
+// statement, so that a role is never visible without its permissions.
+func (m RoleModel) Insert(role *Role) error {
+	query := `
+        WITH role AS (
+            INSERT INTO roles (name, description)
+            VALUES ($1, $2)
+            RETURNING id, created_at, version
+        ), granted AS (
+            INSERT INTO roles_permissions
+            SELECT role.id, permissions.id
+            FROM role, permissions
+            WHERE permissions.code = ANY($3)
+        )
+        SELECT id, created_at, version FROM role`
+
+	args := []any{role.Name, role.Description, pq.Array(role.Permissions)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get() returns a specific role, along with its permissions.
+func (m RoleModel) Get(id int64) (*Role, error) {
+	query := `
+        SELECT roles.id, roles.created_at, roles.name, roles.description, roles.version,
+            array_remove(array_agg(permissions.code ORDER BY permissions.code), NULL)
+        FROM roles
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+        WHERE roles.id = $1
+        GROUP BY roles.id`
+
+	var role Role
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		&role.Version,
+		pq.Array(&role.Permissions),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &role, nil
+}
+
+// GetAll() returns every role, along with their permissions, ordered by name.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+        SELECT roles.id, roles.created_at, roles.name, roles.description, roles.version,
+            array_remove(array_agg(permissions.code ORDER BY permissions.code), NULL)
+        FROM roles
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+        GROUP BY roles.id
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRoles(rows)
+}
+
+// GetAllForUser() returns the roles held by a specific user in an organization, ordered
+// by name.
+func (m RoleModel) GetAllForUser(userID, orgID int64) ([]*Role, error) {
+	query := `
+        SELECT roles.id, roles.created_at, roles.name, roles.description, roles.version,
+            array_remove(array_agg(permissions.code ORDER BY permissions.code), NULL)
+        FROM roles
+        INNER JOIN users_roles ON users_roles.role_id = roles.id
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+        WHERE users_roles.user_id = $1 AND users_roles.org_id = $2
+        GROUP BY roles.id
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRoles(rows)
+}
+
+// The scanRoles() function reads the roles returned by GetAll() and GetAllForUser().
+func scanRoles(rows *sql.Rows) ([]*Role, error) {
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(
+			&role.ID,
+			&role.CreatedAt,
+			&role.Name,
+			&role.Description,
+			&role.Version,
+			pq.Array(&role.Permissions),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Update() changes a role's name, description and permissions, using the version
+// number to detect edit conflicts. Permissions which the role no longer has are
+// removed, and new ones added, in the same statement as the update.
+func (m RoleModel) Update(role *Role) error {
+	query := `
+        WITH role AS (
+            UPDATE roles
+            SET name = $1, description = $2, version = version + 1
+            WHERE id = $3 AND version = $4
+            RETURNING id, version
+        ), revoked AS (
+            DELETE FROM roles_permissions
+            WHERE role_id IN (SELECT id FROM role)
+            AND permission_id NOT IN (SELECT id FROM permissions WHERE code = ANY($5))
+        ), granted AS (
+            INSERT INTO roles_permissions
+            SELECT role.id, permissions.id
+            FROM role, permissions
+            WHERE permissions.code = ANY($5)
+            ON CONFLICT DO NOTHING
+        )
+        SELECT version FROM role`
+
+	args := []any{
+		role.Name,
+		role.Description,
+		role.ID,
+		role.Version,
+		pq.Array(role.Permissions),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete() deletes a specific role. Users who held the role lose the permissions that
+// it granted them.
+func (m RoleModel) Delete(id int64) error {
+	query := `
+        DELETE FROM roles
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// SetForUser() replaces the roles held by a user in an organization, which they must be
+// a member of, with the roles with the given names. Names which don't match a role are
+// ignored.
+func (m RoleModel) SetForUser(userID, orgID int64, names []string) error {
+	query := `
+        WITH revoked AS (
+            DELETE FROM users_roles
+            WHERE user_id = $1 AND org_id = $2
+            AND role_id NOT IN (SELECT id FROM roles WHERE name = ANY($3))
+        )
+        INSERT INTO users_roles (user_id, org_id, role_id)
+        SELECT $1, $2, roles.id FROM roles WHERE roles.name = ANY($3)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, orgID, pq.Array(names))
+	return err
+}
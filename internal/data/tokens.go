@@ -5,9 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"errors"
+	"slices"
 	"time"
 
 	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
 )
 
 // Define constants for the token scope. For now we just define the scope "activation"
@@ -15,17 +18,52 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeDataExport     = "data-export"
+	ScopeEmailChange    = "email-change"
+	ScopeMagicLogin     = "magic-login"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeOAuthRefresh   = "oauth-refresh"
+	ScopeRefresh        = "refresh"
 )
 
+// ErrTokenReused is returned when a single-use token which has already been used is
+// presented again.
+var ErrTokenReused = errors.New("token reused")
+
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and
-// scope.
+// scope, along with the user agent and IP address of the client it was issued to. The
+// Family field links together the access and refresh tokens issued for a single login,
+// so that they can be revoked together. Tokens issued to an OAuth client record the
+// client's ID, and are restricted to the permissions that the user granted it. Tokens
+// issued to an administrator who is impersonating the user record the administrator's
+// ID.
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext      string      `json:"token"`
+	Hash           []byte      `json:"-"`
+	UserID         int64       `json:"-"`
+	Expiry         time.Time   `json:"expiry"`
+	Scope          string      `json:"-"`
+	Family         string      `json:"-"`
+	UserAgent      string      `json:"-"`
+	IP             string      `json:"-"`
+	ClientID       int64       `json:"-"`
+	Permissions    Permissions `json:"-"`
+	ImpersonatorID int64       `json:"-"`
+}
+
+// A Session describes a login (a family of access and refresh tokens) without revealing
+// the tokens themselves. The ID is that of the session's current refresh token, and
+// the Current field is true for the session that was used to make the request.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+	Family     string     `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) *Token {
@@ -50,6 +88,11 @@ func generateToken(userID int64, ttl time.Duration, scope string) *Token {
 	return token
 }
 
+// NewTokenFamily() returns a random identifier for a new family of tokens.
+func NewTokenFamily() string {
+	return rand.Text()
+}
+
 // Check that the plaintext token has been provided and is exactly 26 bytes long.
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
@@ -58,7 +101,7 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
@@ -70,13 +113,74 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewSession() is like New(), but also adds the token to a token family and records the
+// user agent and IP address of the client that the token is being issued to, so that
+// the user can recognise it later.
+func (m TokenModel) NewSession(
+	userID int64,
+	ttl time.Duration,
+	scope, family, userAgent, ip string,
+) (*Token, error) {
+	token := generateToken(userID, ttl, scope)
+	token.Family = family
+	token.UserAgent = userAgent
+	token.IP = ip
+
+	err := m.Insert(token)
+	return token, err
+}
+
+// NewForClient() is like NewSession(), but creates a token for an OAuth client which is
+// restricted to the given permissions.
+func (m TokenModel) NewForClient(
+	userID int64,
+	ttl time.Duration,
+	scope, family string,
+	clientID int64,
+	permissions Permissions,
+) (*Token, error) {
+	token := generateToken(userID, ttl, scope)
+	token.Family = family
+	token.ClientID = clientID
+	token.Permissions = permissions
+
+	err := m.Insert(token)
+	return token, err
+}
+
+// NewImpersonation() creates an authentication token which lets the administrator with
+// the given ID act as the user. It has no refresh token, so it can't be used after it
+// expires.
+func (m TokenModel) NewImpersonation(
+	userID int64,
+	ttl time.Duration,
+	impersonatorID int64,
+) (*Token, error) {
+	token := generateToken(userID, ttl, ScopeAuthentication)
+	token.ImpersonatorID = impersonatorID
+
+	err := m.Insert(token)
+	return token, err
+}
+
 // Insert() adds the data for a specific token to the tokens table.
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-        INSERT INTO tokens (hash, user_id, expiry, scope) 
-        VALUES ($1, $2, $3, $4)`
+        INSERT INTO tokens (hash, user_id, expiry, scope, family, user_agent, ip, client_id, permissions, impersonator_id) 
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NULLIF($8, 0), $9, NULLIF($10, 0))`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{
+		token.Hash,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		token.Family,
+		token.UserAgent,
+		token.IP,
+		token.ClientID,
+		pq.Array(token.Permissions),
+		token.ImpersonatorID,
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -97,3 +201,317 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// Delete() deletes a single token, identified by its scope and plaintext value.
+func (m TokenModel) Delete(scope, tokenPlaintext string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope = $1 AND hash = $2`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// DeleteFamily() deletes the token with the given plaintext value, along with every
+// other token in the same family. We use this to log out of a session completely.
+func (m TokenModel) DeleteFamily(tokenPlaintext string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE hash = $1 OR family = (SELECT family FROM tokens WHERE hash = $1)`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// DeleteAllInFamily() deletes every token in the given family.
+func (m TokenModel) DeleteAllInFamily(family string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE family = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// DeleteFamilyForClient() deletes the token with the given plaintext value, along with
+// every other token in the same family, so long as it was issued to the specified OAuth
+// client.
+func (m TokenModel) DeleteFamilyForClient(clientID int64, tokenPlaintext string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE client_id = $1
+        AND (hash = $2 OR family = (SELECT family FROM tokens WHERE hash = $2 AND client_id = $1))`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, clientID, tokenHash[:])
+	return err
+}
+
+// Consume() marks an unexpired single-use token as used and returns it. If there is no
+// such token, ErrRecordNotFound is returned. If the token exists but has already been
+// used, then it has probably been stolen, so every token in its family is deleted and
+// ErrTokenReused is returned, along with a token holding the revoked family.
+func (m TokenModel) Consume(scope, tokenPlaintext string) (*Token, error) {
+	query := `
+        UPDATE tokens
+        SET used_at = $1
+        WHERE hash = $2 AND scope = $3 AND expiry > $1 AND used_at IS NULL
+        RETURNING user_id, expiry, COALESCE(family, ''), user_agent, ip,
+            COALESCE(client_id, 0), permissions`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     scope,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, time.Now(), token.Hash, scope).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.Family,
+		&token.UserAgent,
+		&token.IP,
+		&token.ClientID,
+		pq.Array(&token.Permissions),
+	)
+	if err == nil {
+		return &token, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// The token couldn't be consumed, so check whether that's because it was used
+	// before. If it was, revoke the whole family.
+	query = `
+        DELETE FROM tokens
+        WHERE family = (
+            SELECT family FROM tokens
+            WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL
+        )
+        RETURNING family`
+
+	families, deleted, err := m.deleteReturningFamilies(query, token.Hash, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted > 0 {
+		if len(families) > 0 {
+			token.Family = families[0]
+		}
+
+		return &token, ErrTokenReused
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+// Touch() records that a token has just been used, along with the user agent and IP
+// address it was used from. The live tokens in the same family are updated too, so
+// that the session's refresh token reflects the latest activity. To avoid writing to
+// the database on every single request, the records are only updated if they haven't
+// been touched in the last minute.
+func (m TokenModel) Touch(tokenPlaintext, userAgent, ip string) error {
+	query := `
+        UPDATE tokens
+        SET last_used_at = $1, user_agent = $2, ip = $3
+        WHERE (hash = $4 OR family = (SELECT family FROM tokens WHERE hash = $4))
+        AND used_at IS NULL
+        AND (last_used_at IS NULL OR last_used_at < $5)`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	now := time.Now()
+
+	args := []any{now, userAgent, ip, tokenHash[:], now.Add(-time.Minute)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetAllSessionsForUser() returns the active sessions for a specific user, most
+// recently created first. Each session is represented by its unused, unexpired refresh
+// token. The session which the token matching currentPlaintext belongs to (if any) is
+// marked as the current session.
+func (m TokenModel) GetAllSessionsForUser(
+	userID int64,
+	currentPlaintext string,
+) ([]*Session, error) {
+	query := `
+        SELECT id, created_at, last_used_at, expiry, user_agent, ip, COALESCE(family, ''),
+            COALESCE(family = (SELECT family FROM tokens WHERE hash = $1), false)
+        FROM tokens
+        WHERE scope = $2 AND user_id = $3 AND expiry > $4 AND used_at IS NULL
+        ORDER BY created_at DESC, id DESC`
+
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	args := []any{currentHash[:], ScopeRefresh, userID, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Family,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteOtherSessionsForUser() deletes every authentication and refresh token for a
+// user (including those issued to OAuth clients), except for those in the given family
+// and the family of the token matching currentPlaintext. This logs the user out
+// everywhere apart from the session making the request. It returns the families of the
+// deleted tokens.
+func (m TokenModel) DeleteOtherSessionsForUser(
+	userID int64,
+	family, currentPlaintext string,
+) ([]string, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $1 AND scope = ANY($2) AND hash <> $3
+        AND (family IS NULL OR (
+            family <> $4
+            AND family IS DISTINCT FROM (SELECT family FROM tokens WHERE hash = $3)
+        ))
+        RETURNING family`
+
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	scopes := []string{ScopeAuthentication, ScopeRefresh, ScopeOAuthRefresh}
+
+	families, _, err := m.deleteReturningFamilies(query, userID, pq.Array(scopes), currentHash[:], family)
+	return families, err
+}
+
+// DeleteAllSessionsForUser() deletes every token which lets a user access their account
+// or finish logging in, including those issued to OAuth clients. This logs the user out
+// everywhere. It returns the families of the deleted tokens.
+func (m TokenModel) DeleteAllSessionsForUser(userID int64) ([]string, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $1 AND scope = ANY($2)
+        RETURNING family`
+
+	scopes := []string{
+		ScopeAuthentication,
+		ScopeMagicLogin,
+		ScopeMFAPending,
+		ScopeOAuthRefresh,
+		ScopeRefresh,
+	}
+
+	families, _, err := m.deleteReturningFamilies(query, userID, pq.Array(scopes))
+	return families, err
+}
+
+// DeleteSessionForUser() deletes the token with the given ID along with every other
+// token in its family, so long as it belongs to the specified user, and returns the
+// family. If there is no such token, ErrRecordNotFound is returned.
+func (m TokenModel) DeleteSessionForUser(userID, id int64) ([]string, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $1 
+        AND (id = $2 OR family = (SELECT family FROM tokens WHERE id = $2 AND user_id = $1))
+        RETURNING family`
+
+	families, deleted, err := m.deleteReturningFamilies(query, userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return families, nil
+}
+
+// The deleteReturningFamilies() helper runs a DELETE query which returns the family of
+// each deleted token, and returns the distinct families along with the number of tokens
+// deleted. Tokens without a family are counted, but have no family to return.
+func (m TokenModel) deleteReturningFamilies(query string, args ...any) ([]string, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	families := []string{}
+	deleted := 0
+
+	for rows.Next() {
+		var family sql.NullString
+
+		err := rows.Scan(&family)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		deleted++
+
+		if family.Valid && family.String != "" && !slices.Contains(families, family.String) {
+			families = append(families, family.String)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return families, deleted, nil
+}
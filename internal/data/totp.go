@@ -0,0 +1,238 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/chlovec/greenlight/internal/totp"
+	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// The number of recovery codes generated when two-factor authentication is enabled.
+const recoveryCodeCount = 10
+
+// Define a TOTP struct to hold a user's TOTP credential. A credential is created
+// unconfirmed when the user starts enrolling, and only takes effect once the user has
+// proved that their authenticator app is set up by supplying a valid code. The
+// LastUsedStep field records the time step of the last code accepted, so that a code
+// can't be used twice. The Secret field holds the shared secret as it's stored, which
+// is encrypted with one of the configured TOTP keys.
+type TOTP struct {
+	UserID       int64
+	Secret       []byte
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+// Check that a TOTP code has been provided and looks sensible.
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == totp.Digits, "code", "must be 6 digits long")
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB DBTX
+}
+
+// Get() retrieves the TOTP credential for a user. If the user hasn't started enrolling,
+// ErrRecordNotFound is returned.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+        SELECT user_id, secret, confirmed, last_used_step
+        FROM users_totp
+        WHERE user_id = $1`
+
+	var credential TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&credential.UserID,
+		&credential.Secret,
+		&credential.Confirmed,
+		&credential.LastUsedStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &credential, nil
+}
+
+// IsEnabled() reports whether the user has a confirmed TOTP credential.
+func (m TOTPModel) IsEnabled(userID int64) (bool, error) {
+	credential, err := m.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return credential.Confirmed, nil
+}
+
+// InsertPending() stores a new unconfirmed credential for the user, replacing any
+// previous unconfirmed one. A confirmed credential is never replaced, and in that case
+// ErrEditConflict is returned.
+func (m TOTPModel) InsertPending(userID int64, secret []byte) error {
+	query := `
+        INSERT INTO users_totp (user_id, secret)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+        WHERE users_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// UseStep() records that a code from the given time step has been accepted, and
+// optionally marks the credential as confirmed. The update only succeeds if the step
+// is later than the last one used, so that if two requests race to use the same code
+// only one of them wins. The loser gets ErrEditConflict.
+func (m TOTPModel) UseStep(userID, step int64, confirm bool) error {
+	query := `
+        UPDATE users_totp
+        SET last_used_step = $1, confirmed = confirmed OR $2
+        WHERE user_id = $3 AND last_used_step < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, step, confirm, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Delete() removes a user's TOTP credential and recovery codes, disabling two-factor
+// authentication. It must be called on models running in a transaction, so that the
+// user can't be left with recovery codes but no credential.
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	return err
+}
+
+// NewRecoveryCodes() generates a fresh set of one-time recovery codes for the user,
+// replacing any existing ones, and returns the plaintext codes. Only their hashes are
+// stored, so this is the only chance to show them to the user. It must be called on
+// models running in a transaction, so that the old codes are never deleted without
+// the new ones being stored.
+func (m TOTPModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		// Format the codes as two groups of five characters, which is easier for
+		// people to copy down than one long string.
+		text := strings.ToLower(rand.Text()[:10])
+		codes[i] = text[:5] + "-" + text[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+        INSERT INTO recovery_codes (hash, user_id)
+        SELECT unnest($1::bytea[]), $2`
+
+	_, err = m.DB.ExecContext(ctx, query, pq.Array(hashes), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode() deletes a matching recovery code for the user, so that it can't be
+// used again. If there is no matching code, ErrRecordNotFound is returned.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) error {
+	query := `
+        DELETE FROM recovery_codes
+        WHERE hash = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// hashRecoveryCode() normalises a recovery code (so that it doesn't matter if the user
+// types it in upper case, or leaves out the hyphen) and returns its SHA-256 hash.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
@@ -5,9 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/chlovec/greenlight/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -23,13 +25,15 @@ var AnonymousUser = &User{}
 // in any output when we encode it to JSON. Also notice that the Password field uses the
 // custom password type defined below.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	PendingEmail *string   `json:"pending_email,omitempty"`
+	Password     password  `json:"-"`
+	Activated    bool      `json:"activated"`
+	Deactivated  bool      `json:"deactivated"`
+	Version      int       `json:"-"`
 }
 
 // Check if a User instance is the AnonymousUser.
@@ -46,13 +50,16 @@ type password struct {
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() method calculates the argon2id hash of a plaintext password, using the
+// current PasswordHashParams, and stores both the hash and the plaintext versions in
+// the struct. If too many passwords are already being hashed, ErrPasswordHashBusy is
+// returned.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := argon2idHash(plaintextPassword, PasswordHashParams)
 	if err != nil {
 		return err
 	}
+
 	p.plaintext = &plaintextPassword
 	p.hash = hash
 
@@ -61,8 +68,20 @@ func (p *password) Set(plaintextPassword string) error {
 
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false
-// otherwise.
+// otherwise. Passwords hashed with bcrypt before we switched to argon2id are still
+// supported. Like Set(), it returns ErrPasswordHashBusy if too many passwords are
+// already being hashed.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
+	if isArgon2idHash(p.hash) {
+		return argon2idMatches(plaintextPassword, p.hash)
+	}
+
+	// Bcrypt only supports passwords up to 72 bytes long, so a longer password can't
+	// match a bcrypt hash.
+	if len(plaintextPassword) > 72 {
+		return false, nil
+	}
+
 	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
 	if err != nil {
 		switch {
@@ -76,6 +95,21 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// The NeedsRehash() method reports whether the stored hash should be replaced, because
+// it was made with bcrypt or with different argon2id parameters to the current ones.
+func (p *password) NeedsRehash() bool {
+	if !isArgon2idHash(p.hash) {
+		return true
+	}
+
+	params, _, _, err := decodeArgon2idHash(p.hash)
+	if err != nil {
+		return true
+	}
+
+	return params != PasswordHashParams
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
@@ -84,7 +118,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= 256, "password", "must not be more than 256 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -113,7 +147,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // Create a UserModel struct which wraps the connection pool.
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // Insert a new record in the database for the user. Note that the id, created_at and
@@ -148,12 +182,47 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	query := `
+        SELECT id, created_at, name, email, pending_email, password_hash, activated, deactivated, version
+        FROM users
+        WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return an ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, pending_email, password_hash, activated, deactivated, version
         FROM users
         WHERE email = $1`
 
@@ -167,8 +236,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Deactivated,
 		&user.Version,
 	)
 	if err != nil {
@@ -183,6 +254,59 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// GetAll() returns a page of the members of an organization whose name or email address
+// contains the search string (ignoring case), or every member if the search string is
+// empty, along with the pagination metadata.
+func (m UserModel) GetAll(orgID int64, search string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, name, email, pending_email, password_hash, activated, deactivated, version
+        FROM users
+        WHERE (strpos(lower(name), lower($1)) > 0 OR strpos(lower(email), lower($1)) > 0 OR $1 = '')
+        AND id IN (SELECT user_id FROM organizations_users WHERE org_id = $4)
+        ORDER BY %s %s, id ASC
+        LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search, filters.limit(), filters.offset(), orgID)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	totalRecords := 0
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.PendingEmail,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Deactivated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
 // Update the details for a specific user. Notice that we check against the version
 // field to help prevent any race conditions during the request cycle, just like we did
 // when updating a movie. And we also check for a violation of the "users_email_key"
@@ -191,15 +315,18 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 func (m UserModel) Update(user *User) error {
 	query := `
         UPDATE users 
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, pending_email = $3, password_hash = $4, activated = $5,
+            deactivated = $6, version = version + 1
+        WHERE id = $7 AND version = $8
         RETURNING version`
 
 	args := []any{
 		user.Name,
 		user.Email,
+		user.PendingEmail,
 		user.Password.hash,
 		user.Activated,
+		user.Deactivated,
 		user.ID,
 		user.Version,
 	}
@@ -222,6 +349,33 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// Delete() deletes a specific user. Their tokens, API keys, permissions and other
+// records which belong to them are deleted along with them by the database.
+func (m UserModel) Delete(id int64) error {
+	query := `
+        DELETE FROM users
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
@@ -229,7 +383,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	// Set up the SQL query.
 	query := `
-        SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+        SELECT users.id, users.created_at, users.name, users.email, users.pending_email, users.password_hash, users.activated, users.deactivated, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -255,8 +409,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Deactivated,
 		&user.Version,
 	)
 	if err != nil {
@@ -271,3 +427,64 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	// Return the matching user.
 	return &user, nil
 }
+
+// GetForAuthenticationToken() is like GetForToken() for authentication tokens, but also
+// returns the token itself, which records the OAuth client that it was issued to (if
+// any), the permissions that it is restricted to (nil unless the token was issued to an
+// OAuth client) and, for impersonation tokens, the administrator who is impersonating
+// the user. Tokens belonging to deactivated users are treated as if they don't exist.
+func (m UserModel) GetForAuthenticationToken(tokenPlaintext string) (*User, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT users.id, users.created_at, users.name, users.email, users.pending_email, users.password_hash, users.activated, users.deactivated, users.version,
+            tokens.expiry, tokens.permissions, COALESCE(tokens.client_id, 0), COALESCE(tokens.impersonator_id, 0)
+        FROM users
+        INNER JOIN tokens
+        ON users.id = tokens.user_id
+        WHERE tokens.hash = $1
+        AND tokens.scope = $2 
+        AND tokens.expiry > $3
+        AND NOT users.deactivated`
+
+	args := []any{tokenHash[:], ScopeAuthentication, time.Now()}
+
+	user := User{}
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeAuthentication,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+		&token.Expiry,
+		pq.Array(&token.Permissions),
+		&token.ClientID,
+		&token.ImpersonatorID,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+
+	return &user, &token, nil
+}
@@ -0,0 +1,230 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The testKey() function returns a key spec for ParseKeySet() with a seed made of the
+// given byte repeated.
+func testKey(kid string, b byte) string {
+	return kid + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func mustParseKeySet(t *testing.T, specs ...string) *KeySet {
+	t.Helper()
+
+	ks, err := ParseKeySet(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ks
+}
+
+func testClaims(expiry time.Time) *Claims {
+	return &Claims{
+		Subject:     "42",
+		ID:          "token-id",
+		IssuedAt:    time.Now().Unix(),
+		Expiry:      expiry.Unix(),
+		Family:      "family",
+		Activated:   true,
+		OrgID:       7,
+		Permissions: []string{"movies:read", "movies:write"},
+	}
+}
+
+// The tokenHeader() function decodes the header of a signed token.
+func tokenHeader(t *testing.T, token string) header {
+	t.Helper()
+
+	h, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr header
+
+	err = json.Unmarshal(h, &hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hdr
+}
+
+func TestParseKeySet(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		wantErr bool
+	}{
+		{"one key", []string{testKey("a", 1)}, false},
+		{"several keys", []string{testKey("a", 1), testKey("b", 2)}, false},
+		{"raw URL encoding", []string{"a:" + base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 32))}, false},
+		{"no keys", nil, true},
+		{"missing kid", []string{strings.TrimPrefix(testKey("a", 1), "a")}, true},
+		{"missing separator", []string{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))}, true},
+		{"invalid base64", []string{"a:not base64!"}, true},
+		{"short seed", []string{"a:" + base64.StdEncoding.EncodeToString([]byte("too short"))}, true},
+		{"duplicate kid", []string{testKey("a", 1), testKey("a", 2)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeySet(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseKeySet() error = %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	ks := mustParseKeySet(t, testKey("current", 1))
+
+	claims := testClaims(time.Now().Add(time.Hour))
+
+	token, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !LooksLikeJWT(token) {
+		t.Errorf("LooksLikeJWT(%q) = false", token)
+	}
+
+	if hdr := tokenHeader(t, token); hdr.KeyID != "current" || hdr.Algorithm != "EdDSA" {
+		t.Errorf("header = %+v; want kid current and alg EdDSA", hdr)
+	}
+
+	got, err := ks.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, claims) {
+		t.Errorf("Verify() = %+v; want %+v", got, claims)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ks := mustParseKeySet(t, testKey("current", 1))
+
+	valid, err := ks.Sign(testClaims(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := ks.Sign(testClaims(time.Now().Add(-time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := mustParseKeySet(t, testKey("current", 2)).Sign(testClaims(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownKey, err := mustParseKeySet(t, testKey("unknown", 1)).Sign(testClaims(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(valid, ".")
+
+	// A token with the same claims and signature, but with the payload changed to
+	// grant an extra permission.
+	tamperedClaims := testClaims(time.Now().Add(time.Hour))
+	tamperedClaims.Permissions = append(tamperedClaims.Permissions, "users:admin")
+	js, _ := json.Marshal(tamperedClaims)
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(js) + "." + parts[2]
+
+	// A token which claims not to need a signature.
+	js, _ = json.Marshal(header{Algorithm: "none", Type: "JWT", KeyID: "current"})
+	unsigned := base64.RawURLEncoding.EncodeToString(js) + "." + parts[1] + "."
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, ErrExpiredToken},
+		{"signed by another key with the same kid", otherKey, ErrInvalidToken},
+		{"unknown kid", unknownKey, ErrUnknownKey},
+		{"tampered payload", tampered, ErrInvalidToken},
+		{"truncated signature", parts[0] + "." + parts[1] + "." + parts[2][:10], ErrInvalidToken},
+		{"alg none", unsigned, ErrInvalidToken},
+		{"two segments", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"invalid header encoding", "!." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"empty", "", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	before := mustParseKeySet(t, testKey("old", 1))
+	during := mustParseKeySet(t, testKey("new", 2), testKey("old", 1))
+	after := mustParseKeySet(t, testKey("new", 2))
+
+	oldToken, err := before.Sign(testClaims(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, err := during.Sign(testClaims(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New tokens are signed with the first key in the set.
+	if kid := tokenHeader(t, newToken).KeyID; kid != "new" {
+		t.Errorf("new token kid = %q; want %q", kid, "new")
+	}
+
+	tests := []struct {
+		name    string
+		ks      *KeySet
+		token   string
+		wantErr error
+	}{
+		{"old token before rotation", before, oldToken, nil},
+		{"old token during rotation", during, oldToken, nil},
+		{"new token during rotation", during, newToken, nil},
+		{"new token after rotation", after, newToken, nil},
+		{"old token after retirement", after, oldToken, ErrUnknownKey},
+		{"new token before rotation", before, newToken, ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.ks.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Every key in the set is published, so that tokens signed with the old key can
+	// still be verified elsewhere.
+	jwks := during.PublicKeys()
+	if len(jwks) != 2 || jwks[0].KeyID != "new" || jwks[1].KeyID != "old" {
+		t.Errorf("PublicKeys() = %+v; want keys new and old", jwks)
+	}
+}
@@ -0,0 +1,78 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+)
+
+// The Breached type checks passwords against a corpus of passwords which have appeared
+// in data breaches. The corpus is a file of raw 20-byte SHA-1 hashes, sorted in
+// ascending order (for example, the Have I Been Pwned "ordered by hash" list with the
+// hex hashes decoded and the counts removed). The file isn't loaded into memory;
+// instead each check is a binary search reading a handful of records from disk, so
+// even a corpus of hundreds of millions of passwords can be used.
+type Breached struct {
+	file  *os.File
+	count int64
+}
+
+// OpenBreached() opens the corpus at the given path.
+func OpenBreached(path string) (*Breached, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size()%sha1.Size != 0 {
+		file.Close()
+		return nil, fmt.Errorf("breached password file %s is not a whole number of hashes", path)
+	}
+
+	return &Breached{file: file, count: info.Size() / sha1.Size}, nil
+}
+
+// Count() returns the number of hashes in the corpus.
+func (b *Breached) Count() int64 {
+	return b.count
+}
+
+// Contains() reports whether the plaintext password appears in the corpus.
+func (b *Breached) Contains(plaintext string) (bool, error) {
+	hash := sha1.Sum([]byte(plaintext))
+	record := make([]byte, sha1.Size)
+
+	lo, hi := int64(0), b.count
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		_, err := b.file.ReadAt(record, mid*sha1.Size)
+		if err != nil {
+			return false, err
+		}
+
+		switch cmp := bytes.Compare(record, hash[:]); {
+		case cmp == 0:
+			return true, nil
+		case cmp < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// Close() closes the corpus file.
+func (b *Breached) Close() error {
+	return b.file.Close()
+}
@@ -0,0 +1,129 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// The writeCorpus() function writes a breached password corpus containing the given
+// passwords to a temporary file, and returns its path.
+func writeCorpus(t *testing.T, passwords ...string) string {
+	t.Helper()
+
+	hashes := make([][]byte, len(passwords))
+	for i, password := range passwords {
+		hash := sha1.Sum([]byte(password))
+		hashes[i] = hash[:]
+	}
+
+	slices.SortFunc(hashes, bytes.Compare)
+
+	path := filepath.Join(t.TempDir(), "breached.bin")
+
+	err := os.WriteFile(path, bytes.Join(hashes, nil), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func openCorpus(t *testing.T, path string) *Breached {
+	t.Helper()
+
+	b, err := OpenBreached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	return b
+}
+
+func TestBreachedContains(t *testing.T) {
+	breached := []string{"password", "123456", "letmein", "qwerty", "hunter2", "correct horse battery staple", ""}
+
+	tests := []struct {
+		name      string
+		corpus    []string
+		plaintext string
+		want      bool
+	}{
+		{"first of several", breached, "password", true},
+		{"middle of several", breached, "letmein", true},
+		{"another of several", breached, "hunter2", true},
+		{"with spaces", breached, "correct horse battery staple", true},
+		{"empty password", breached, "", true},
+		{"not in corpus", breached, "a much better password", false},
+		{"differs by case", breached, "Password", false},
+		{"prefix of a breached password", breached, "hunter", false},
+		{"only entry", []string{"password"}, "password", true},
+		{"not the only entry", []string{"password"}, "letmein", false},
+		{"empty corpus", nil, "password", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := openCorpus(t, writeCorpus(t, tt.corpus...))
+
+			if b.Count() != int64(len(tt.corpus)) {
+				t.Errorf("Count() = %d; want %d", b.Count(), len(tt.corpus))
+			}
+
+			got, err := b.Contains(tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Contains(%q) = %t; want %t", tt.plaintext, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreachedContainsEveryEntry(t *testing.T) {
+	// Check every entry of a larger corpus, so that the binary search is exercised at
+	// every position, including both ends.
+	var passwords []string
+	for i := range 1000 {
+		passwords = append(passwords, fmt.Sprintf("password%d", i))
+	}
+
+	b := openCorpus(t, writeCorpus(t, passwords...))
+
+	for _, password := range passwords {
+		got, err := b.Contains(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !got {
+			t.Errorf("Contains(%q) = false; want true", password)
+		}
+	}
+}
+
+func TestOpenBreachedInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "truncated.bin")
+
+	err := os.WriteFile(path, make([]byte, sha1.Size+1), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenBreached(path)
+	if err == nil {
+		t.Error("OpenBreached() of a truncated file succeeded; want an error")
+	}
+
+	_, err = OpenBreached(filepath.Join(t.TempDir(), "missing.bin"))
+	if err == nil {
+		t.Error("OpenBreached() of a missing file succeeded; want an error")
+	}
+}
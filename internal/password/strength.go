@@ -0,0 +1,259 @@
+package password
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Define the strength scores returned by Estimate(), from weakest to strongest.
+const (
+	VeryWeak = iota
+	Weak
+	Fair
+	Strong
+	VeryStrong
+)
+
+// The Result type holds the outcome of estimating a password's strength. Warning
+// describes the main reason a weak password is weak, and is empty if there isn't a
+// specific one.
+type Result struct {
+	Score   int
+	Bits    float64
+	Warning string
+}
+
+// Define the warnings that Estimate() can return.
+const (
+	WarningCommon     = "must not be a commonly used password"
+	WarningWords      = "must not be based on commonly used passwords"
+	WarningUserInputs = "must not contain your name or email address"
+	WarningPatterns   = "must not be made up of repeated characters, sequences or keyboard patterns"
+	WarningGuessable  = "is too easy to guess, try a longer password or add some less common words"
+)
+
+//go:embed common.txt
+var commonText string
+
+// The common map holds the most commonly used passwords, which are also used as a
+// dictionary of words that attackers try first.
+var common = func() map[string]bool {
+	words := make(map[string]bool)
+
+	for _, word := range strings.Fields(commonText) {
+		words[word] = true
+	}
+
+	return words
+}()
+
+// The bits an attacker needs to guess a word from the common list. There are a few
+// hundred words, so this is about 8 bits.
+var commonWordBits = math.Log2(float64(len(common)))
+
+// leet maps common character substitutions back to the letters they replace.
+var leet = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "5", "s", "$", "s", "7", "t", "2", "z",
+)
+
+// keyboardRows holds the rows of a QWERTY keyboard, which are often used as patterns.
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// Estimate() estimates how hard a password would be to guess, without needing any
+// external service. It is a simplified version of the approach taken by zxcvbn: rather
+// than assuming that every character is chosen at random, it gives little credit for
+// common passwords, repeated characters, sequences, keyboard patterns and words taken
+// from userInputs (such as the user's name and email address).
+func Estimate(plaintext string, userInputs ...string) Result {
+	lower := strings.ToLower(plaintext)
+	normalized := leet.Replace(lower)
+
+	// A password which is just a common password, perhaps with some digits or symbols
+	// added at the end, is one of the first things an attacker tries.
+	stripped := leet.Replace(strings.TrimRightFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}))
+	if common[normalized] || common[stripped] {
+		return Result{Score: VeryWeak, Warning: WarningCommon}
+	}
+
+	for _, word := range userWords(userInputs) {
+		if strings.Contains(normalized, word) {
+			return Result{Score: VeryWeak, Warning: WarningUserInputs}
+		}
+	}
+
+	bits, wordRunes, patternRunes := estimateBits(plaintext, normalized)
+	score := scoreFor(bits)
+
+	result := Result{Score: score, Bits: bits}
+
+	if score < Fair {
+		length := len([]rune(plaintext))
+
+		switch {
+		case wordRunes*2 >= length:
+			result.Warning = WarningWords
+		case patternRunes*2 >= length:
+			result.Warning = WarningPatterns
+		default:
+			result.Warning = WarningGuessable
+		}
+	}
+
+	return result
+}
+
+// The estimateBits() function estimates the number of bits of entropy in a password. It
+// also returns how many of its characters were part of common words, and how many were
+// part of some other predictable pattern.
+func estimateBits(plaintext, normalized string) (float64, int, int) {
+	runes := []rune(plaintext)
+	lower := []rune(normalized)
+	pool := poolSize(runes)
+
+	var (
+		bits         float64
+		wordRunes    int
+		patternRunes int
+	)
+
+	for i := 0; i < len(runes); {
+		// Common words inside the password are worth about as much as a single random
+		// character, however long they are.
+		if n := commonWordAt(lower, i); n > 0 {
+			bits += commonWordBits
+			wordRunes += n
+			i += n
+			continue
+		}
+
+		// Characters which repeat or continue a sequence or keyboard pattern are worth
+		// very little.
+		if i > 0 && predictable(lower[i-1], lower[i]) {
+			bits += 1
+			patternRunes++
+			i++
+			continue
+		}
+
+		bits += math.Log2(float64(pool))
+		i++
+	}
+
+	return bits, wordRunes, patternRunes
+}
+
+// The commonWordAt() function returns the length of the longest common word (of at
+// least four characters) starting at index i, or 0 if there isn't one.
+func commonWordAt(runes []rune, i int) int {
+	for n := len(runes) - i; n >= 4; n-- {
+		if common[string(runes[i:i+n])] {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// The predictable() function reports whether the character b is easy to guess given
+// that it follows a: the same character, the next or previous character (like "abc" or
+// "321"), or the neighbouring key on the keyboard.
+func predictable(a, b rune) bool {
+	if a == b || a+1 == b || a-1 == b {
+		return true
+	}
+
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		if i < 0 {
+			continue
+		}
+
+		if (i+1 < len(row) && rune(row[i+1]) == b) || (i > 0 && rune(row[i-1]) == b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The poolSize() function returns the number of possible characters that an attacker
+// would need to try for each position, based on the kinds of character used.
+func poolSize(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+
+	return max(size, 2)
+}
+
+// The userWords() function splits the user inputs (for example, "Alice Smith" and
+// "alice.smith@example.com") into lowercase words of at least four characters.
+func userWords(userInputs []string) []string {
+	var words []string
+
+	for _, input := range userInputs {
+		fields := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		for _, field := range fields {
+			if len([]rune(field)) >= 4 {
+				words = append(words, field)
+			}
+		}
+	}
+
+	return words
+}
+
+// The scoreFor() function converts bits of entropy to a score.
+func scoreFor(bits float64) int {
+	switch {
+	case bits < 28:
+		return VeryWeak
+	case bits < 36:
+		return Weak
+	case bits < 60:
+		return Fair
+	case bits < 80:
+		return Strong
+	default:
+		return VeryStrong
+	}
+}
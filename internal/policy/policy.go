@@ -0,0 +1,343 @@
+// Package policy implements a small attribute-based authorization engine. A policy is a
+// list of rules, each of which allows or denies a set of actions on a type of resource
+// when all of its conditions hold. Conditions compare attributes of the subject (the
+// user making the request) and of the resource with each other, or with literal values.
+//
+// A request is denied if any matching rule denies it, otherwise allowed if any matching
+// rule allows it, and otherwise denied.
+package policy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// DefaultRules is the policy used when no policy file is configured.
+//
+//go:embed default.json
+var DefaultRules []byte
+
+// The effects that a rule can have.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// The operators that a condition can use.
+const (
+	// OpEq and OpNe compare two values for (in)equality. Both fail if either value is
+	// missing.
+	OpEq = "eq"
+	OpNe = "ne"
+	// OpIn checks that the attribute is one of the values in a list.
+	OpIn = "in"
+	// OpContains checks that the attribute (a list) contains the value.
+	OpContains = "contains"
+	// OpIntersects checks that the attribute and the value (both lists) have at least
+	// one element in common.
+	OpIntersects = "intersects"
+	// OpSubsetOf checks that every element of the attribute (a list) is in the value
+	// (also a list).
+	OpSubsetOf = "subset_of"
+)
+
+var operators = []string{OpEq, OpNe, OpIn, OpContains, OpIntersects, OpSubsetOf}
+
+// Attributes holds the attributes of a subject or resource. Values should be strings,
+// booleans, numbers, or slices of strings or numbers.
+type Attributes map[string]any
+
+// A Resource is the thing that an action is performed on, such as a movie.
+type Resource struct {
+	Type       string     `json:"type"`
+	Attributes Attributes `json:"attributes"`
+}
+
+// A Condition compares the attribute at a path (such as "resource.created_by") with
+// either a literal Value or the attribute at the ValueFrom path (such as "subject.id").
+type Condition struct {
+	Attribute string `json:"attribute"`
+	Operator  string `json:"operator"`
+	Value     any    `json:"value,omitempty"`
+	ValueFrom string `json:"value_from,omitempty"`
+}
+
+// A Rule applies its effect to the listed actions on resources of the given type ("*"
+// matches any action or type) when all of its conditions hold. A rule without
+// conditions always applies.
+type Rule struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Effect      string      `json:"effect"`
+	Actions     []string    `json:"actions"`
+	Resource    string      `json:"resource"`
+	Conditions  []Condition `json:"conditions,omitempty"`
+}
+
+// An Engine evaluates requests against a set of rules. It is safe for concurrent use,
+// as the rules are never modified after loading.
+type Engine struct {
+	rules []Rule
+}
+
+// Load parses and checks a policy, which is a JSON object with a "rules" array.
+func Load(js []byte) (*Engine, error) {
+	var policy struct {
+		Rules []Rule `json:"rules"`
+	}
+
+	err := json.Unmarshal(js, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+
+	for i, rule := range policy.Rules {
+		err := checkRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("policy: rule %d (%q): %w", i, rule.Name, err)
+		}
+	}
+
+	return &Engine{rules: policy.Rules}, nil
+}
+
+// LoadFile reads a policy from a file. If path is empty, DefaultRules are used.
+func LoadFile(path string) (*Engine, error) {
+	if path == "" {
+		return Load(DefaultRules)
+	}
+
+	js, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Load(js)
+}
+
+func checkRule(rule Rule) error {
+	switch {
+	case rule.Name == "":
+		return errors.New("name must be provided")
+	case rule.Effect != Allow && rule.Effect != Deny:
+		return fmt.Errorf("effect must be %q or %q", Allow, Deny)
+	case len(rule.Actions) == 0:
+		return errors.New("actions must be provided")
+	case rule.Resource == "":
+		return errors.New("resource must be provided")
+	}
+
+	for _, condition := range rule.Conditions {
+		switch {
+		case !validPath(condition.Attribute):
+			return fmt.Errorf("attribute %q must start with \"subject.\" or \"resource.\"", condition.Attribute)
+		case !slices.Contains(operators, condition.Operator):
+			return fmt.Errorf("unknown operator %q", condition.Operator)
+		case condition.ValueFrom != "" && condition.Value != nil:
+			return errors.New("a condition can't have both value and value_from")
+		case condition.ValueFrom != "" && !validPath(condition.ValueFrom):
+			return fmt.Errorf("value_from %q must start with \"subject.\" or \"resource.\"", condition.ValueFrom)
+		}
+	}
+
+	return nil
+}
+
+func validPath(path string) bool {
+	return strings.HasPrefix(path, "subject.") || strings.HasPrefix(path, "resource.")
+}
+
+// A Decision is the outcome of evaluating a request. Rules explains how each rule
+// which applies to the action and resource type was evaluated.
+type Decision struct {
+	Allowed bool         `json:"allowed"`
+	Reason  string       `json:"reason"`
+	Rules   []RuleResult `json:"rules"`
+}
+
+// A RuleResult records whether a rule matched, and the result of each of its
+// conditions.
+type RuleResult struct {
+	Name       string            `json:"name"`
+	Effect     string            `json:"effect"`
+	Matched    bool              `json:"matched"`
+	Conditions []ConditionResult `json:"conditions"`
+}
+
+// A ConditionResult records the values which a condition compared, and whether it
+// held.
+type ConditionResult struct {
+	Condition
+	Actual   any  `json:"actual"`
+	Expected any  `json:"expected"`
+	Passed   bool `json:"passed"`
+}
+
+// Evaluate decides whether the subject may perform the action on the resource.
+func (e *Engine) Evaluate(subject Attributes, action string, resource Resource) Decision {
+	decision := Decision{Rules: []RuleResult{}}
+
+	var allowedBy, deniedBy string
+
+	for _, rule := range e.rules {
+		if !matches(rule.Actions, action) || !matches([]string{rule.Resource}, resource.Type) {
+			continue
+		}
+
+		result := RuleResult{
+			Name:       rule.Name,
+			Effect:     rule.Effect,
+			Matched:    true,
+			Conditions: []ConditionResult{},
+		}
+
+		for _, condition := range rule.Conditions {
+			conditionResult := evaluateCondition(condition, subject, resource.Attributes)
+			result.Conditions = append(result.Conditions, conditionResult)
+
+			if !conditionResult.Passed {
+				result.Matched = false
+			}
+		}
+
+		if result.Matched {
+			switch {
+			case rule.Effect == Deny && deniedBy == "":
+				deniedBy = rule.Name
+			case rule.Effect == Allow && allowedBy == "":
+				allowedBy = rule.Name
+			}
+		}
+
+		decision.Rules = append(decision.Rules, result)
+	}
+
+	switch {
+	case deniedBy != "":
+		decision.Reason = fmt.Sprintf("denied by rule %q", deniedBy)
+	case allowedBy != "":
+		decision.Allowed = true
+		decision.Reason = fmt.Sprintf("allowed by rule %q", allowedBy)
+	default:
+		decision.Reason = "no rule allows this action"
+	}
+
+	return decision
+}
+
+// Allowed is a shortcut for Evaluate(subject, action, resource).Allowed.
+func (e *Engine) Allowed(subject Attributes, action string, resource Resource) bool {
+	return e.Evaluate(subject, action, resource).Allowed
+}
+
+func matches(patterns []string, value string) bool {
+	return slices.Contains(patterns, "*") || slices.Contains(patterns, value)
+}
+
+func evaluateCondition(condition Condition, subject, resource Attributes) ConditionResult {
+	result := ConditionResult{
+		Condition: condition,
+		Actual:    lookup(condition.Attribute, subject, resource),
+		Expected:  condition.Value,
+	}
+
+	if condition.ValueFrom != "" {
+		result.Expected = lookup(condition.ValueFrom, subject, resource)
+	}
+
+	actual := normalize(result.Actual)
+	expected := normalize(result.Expected)
+
+	switch condition.Operator {
+	case OpEq:
+		result.Passed = actual != nil && equal(actual, expected)
+	case OpNe:
+		result.Passed = actual != nil && expected != nil && !equal(actual, expected)
+	case OpIn:
+		result.Passed = actual != nil && containsValue(expected, actual)
+	case OpContains:
+		result.Passed = expected != nil && containsValue(actual, expected)
+	case OpIntersects:
+		list, _ := actual.([]any)
+		result.Passed = slices.ContainsFunc(list, func(v any) bool { return containsValue(expected, v) })
+	case OpSubsetOf:
+		list, ok := actual.([]any)
+		result.Passed = ok && !slices.ContainsFunc(list, func(v any) bool { return !containsValue(expected, v) })
+	}
+
+	return result
+}
+
+// The lookup() function returns the value of the attribute at a path, or nil if there
+// is no such attribute.
+func lookup(path string, subject, resource Attributes) any {
+	if name, ok := strings.CutPrefix(path, "subject."); ok {
+		return subject[name]
+	}
+
+	if name, ok := strings.CutPrefix(path, "resource."); ok {
+		return resource[name]
+	}
+
+	return nil
+}
+
+// The normalize() function converts numbers to float64 (as they are when decoded from
+// JSON) and slices to []any, so that attribute values from Go code can be compared with
+// values from the policy file.
+func normalize(value any) any {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case []string:
+		list := make([]any, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	case []int64:
+		list := make([]any, len(v))
+		for i, n := range v {
+			list[i] = float64(n)
+		}
+		return list
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = normalize(item)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+func equal(a, b any) bool {
+	_, aIsList := a.([]any)
+	_, bIsList := b.([]any)
+	if aIsList || bIsList {
+		return false
+	}
+
+	return a == b
+}
+
+// The containsValue() function reports whether list (which should be a []any) has an
+// element equal to value.
+func containsValue(list, value any) bool {
+	items, ok := list.([]any)
+	if !ok {
+		return false
+	}
+
+	return slices.ContainsFunc(items, func(item any) bool { return equal(item, value) })
+}
@@ -0,0 +1,275 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustLoad(t *testing.T, js string) *Engine {
+	t.Helper()
+
+	e, err := Load([]byte(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func movie(createdBy int64, genres ...string) Resource {
+	return Resource{
+		Type: "movie",
+		Attributes: Attributes{
+			"id":         int64(1),
+			"created_by": createdBy,
+			"org_id":     int64(1),
+			"genres":     genres,
+		},
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		js      string
+		wantErr bool
+	}{
+		{"no rules", `{"rules": []}`, false},
+		{"valid rule", `{"rules": [{"name": "r", "effect": "allow", "actions": ["*"], "resource": "*"}]}`, false},
+		{"invalid JSON", `{"rules": [`, true},
+		{"missing name", `{"rules": [{"effect": "allow", "actions": ["*"], "resource": "*"}]}`, true},
+		{"unknown effect", `{"rules": [{"name": "r", "effect": "maybe", "actions": ["*"], "resource": "*"}]}`, true},
+		{"no actions", `{"rules": [{"name": "r", "effect": "allow", "actions": [], "resource": "*"}]}`, true},
+		{"no resource", `{"rules": [{"name": "r", "effect": "allow", "actions": ["*"]}]}`, true},
+		{
+			"unknown attribute prefix",
+			`{"rules": [{"name": "r", "effect": "allow", "actions": ["*"], "resource": "*",
+				"conditions": [{"attribute": "user.id", "operator": "eq", "value": 1}]}]}`,
+			true,
+		},
+		{
+			"unknown operator",
+			`{"rules": [{"name": "r", "effect": "allow", "actions": ["*"], "resource": "*",
+				"conditions": [{"attribute": "subject.id", "operator": "gt", "value": 1}]}]}`,
+			true,
+		},
+		{
+			"value and value_from",
+			`{"rules": [{"name": "r", "effect": "allow", "actions": ["*"], "resource": "*",
+				"conditions": [{"attribute": "subject.id", "operator": "eq", "value": 1, "value_from": "resource.created_by"}]}]}`,
+			true,
+		},
+		{
+			"invalid value_from",
+			`{"rules": [{"name": "r", "effect": "allow", "actions": ["*"], "resource": "*",
+				"conditions": [{"attribute": "subject.id", "operator": "eq", "value_from": "created_by"}]}]}`,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load([]byte(tt.js))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluateDefaultRules(t *testing.T) {
+	e, err := LoadFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := Attributes{"id": int64(1), "permissions": []string{"movies:write"}}
+	other := Attributes{"id": int64(2), "permissions": []string{"movies:write"}}
+	admin := Attributes{"id": int64(3), "permissions": []string{"movies:write", "movies:admin"}}
+
+	tests := []struct {
+		name     string
+		subject  Attributes
+		action   string
+		resource Resource
+		want     bool
+	}{
+		{"owner updates", owner, "movies:update", movie(1), true},
+		{"owner deletes", owner, "movies:delete", movie(1), true},
+		{"other user updates", other, "movies:update", movie(1), false},
+		{"other user deletes", other, "movies:delete", movie(1), false},
+		{"admin updates", admin, "movies:update", movie(1), true},
+		{"admin deletes", admin, "movies:delete", movie(1), true},
+		{"movie without a creator", other, "movies:update", movie(0), false},
+		{"unknown action", owner, "movies:publish", movie(1), false},
+		{"unknown resource type", owner, "movies:update", Resource{Type: "review", Attributes: Attributes{"created_by": int64(1)}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := e.Evaluate(tt.subject, tt.action, tt.resource)
+			if decision.Allowed != tt.want {
+				t.Errorf("Evaluate() = %+v; want allowed %t", decision, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateDenyOverridesAllow(t *testing.T) {
+	e := mustLoad(t, `{"rules": [
+		{"name": "everyone", "effect": "allow", "actions": ["*"], "resource": "*"},
+		{"name": "not-archived", "effect": "deny", "actions": ["movies:update"], "resource": "movie",
+			"conditions": [{"attribute": "resource.archived", "operator": "eq", "value": true}]}
+	]}`)
+
+	archived := Resource{Type: "movie", Attributes: Attributes{"archived": true}}
+	current := Resource{Type: "movie", Attributes: Attributes{"archived": false}}
+
+	tests := []struct {
+		name       string
+		action     string
+		resource   Resource
+		want       bool
+		wantReason string
+	}{
+		{"denied", "movies:update", archived, false, `denied by rule "not-archived"`},
+		{"allowed", "movies:update", current, true, `allowed by rule "everyone"`},
+		{"other action", "movies:delete", archived, true, `allowed by rule "everyone"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := e.Evaluate(Attributes{}, tt.action, tt.resource)
+			if decision.Allowed != tt.want || decision.Reason != tt.wantReason {
+				t.Errorf("Evaluate() = %t, %q; want %t, %q", decision.Allowed, decision.Reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestEvaluateNoRules(t *testing.T) {
+	decision := mustLoad(t, `{"rules": []}`).Evaluate(Attributes{}, "movies:update", movie(1))
+	if decision.Allowed || decision.Reason != "no rule allows this action" || len(decision.Rules) != 0 {
+		t.Errorf("Evaluate() = %+v; want denied with no rules", decision)
+	}
+}
+
+func TestEvaluateOperators(t *testing.T) {
+	subject := Attributes{
+		"id":     int64(5),
+		"name":   "alice",
+		"roles":  []string{"editor", "reviewer"},
+		"genres": []any{"drama", "comedy"},
+		"ids":    []int64{4, 5, 6},
+	}
+
+	resource := Resource{
+		Type: "movie",
+		Attributes: Attributes{
+			"created_by": int64(5),
+			"year":       int32(1999),
+			"genres":     []string{"drama"},
+			"tags":       []string{"drama", "horror"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		condition string
+		want      bool
+	}{
+		{"eq attributes", `{"attribute": "resource.created_by", "operator": "eq", "value_from": "subject.id"}`, true},
+		{"eq number literal", `{"attribute": "resource.year", "operator": "eq", "value": 1999}`, true},
+		{"eq string literal", `{"attribute": "subject.name", "operator": "eq", "value": "alice"}`, true},
+		{"eq different", `{"attribute": "subject.name", "operator": "eq", "value": "bob"}`, false},
+		{"eq missing attribute", `{"attribute": "subject.missing", "operator": "eq", "value_from": "resource.missing"}`, false},
+		{"eq lists", `{"attribute": "resource.genres", "operator": "eq", "value_from": "resource.genres"}`, false},
+		{"ne", `{"attribute": "subject.name", "operator": "ne", "value": "bob"}`, true},
+		{"ne same", `{"attribute": "subject.name", "operator": "ne", "value": "alice"}`, false},
+		{"ne missing attribute", `{"attribute": "resource.missing", "operator": "ne", "value": "restricted"}`, false},
+		{"ne missing value", `{"attribute": "resource.created_by", "operator": "ne", "value_from": "subject.missing"}`, false},
+		{"in", `{"attribute": "subject.name", "operator": "in", "value": ["alice", "bob"]}`, true},
+		{"in number", `{"attribute": "resource.created_by", "operator": "in", "value_from": "subject.ids"}`, true},
+		{"not in", `{"attribute": "subject.name", "operator": "in", "value": ["bob"]}`, false},
+		{"in missing attribute", `{"attribute": "subject.missing", "operator": "in", "value": ["alice"]}`, false},
+		{"contains", `{"attribute": "subject.roles", "operator": "contains", "value": "editor"}`, true},
+		{"does not contain", `{"attribute": "subject.roles", "operator": "contains", "value": "admin"}`, false},
+		{"contains on a non-list", `{"attribute": "subject.name", "operator": "contains", "value": "alice"}`, false},
+		{"intersects", `{"attribute": "resource.tags", "operator": "intersects", "value_from": "subject.genres"}`, true},
+		{"does not intersect", `{"attribute": "resource.tags", "operator": "intersects", "value": ["comedy"]}`, false},
+		{"intersects missing attribute", `{"attribute": "resource.tags", "operator": "intersects", "value_from": "subject.missing"}`, false},
+		{"subset_of", `{"attribute": "resource.genres", "operator": "subset_of", "value_from": "subject.genres"}`, true},
+		{"not subset_of", `{"attribute": "resource.tags", "operator": "subset_of", "value_from": "subject.genres"}`, false},
+		{"subset_of on a non-list", `{"attribute": "subject.name", "operator": "subset_of", "value": ["alice"]}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := mustLoad(t, `{"rules": [{"name": "r", "effect": "allow", "actions": ["*"], "resource": "movie",
+				"conditions": [`+tt.condition+`]}]}`)
+
+			decision := e.Evaluate(subject, "movies:update", resource)
+			if decision.Allowed != tt.want {
+				t.Errorf("Evaluate() = %+v; want allowed %t", decision, tt.want)
+			}
+		})
+	}
+}
+
+func TestExamplePolicies(t *testing.T) {
+	paths, err := filepath.Glob("examples/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) == 0 {
+		t.Fatal("no example policies found")
+	}
+
+	for _, path := range paths {
+		_, err := LoadFile(path)
+		if err != nil {
+			t.Errorf("LoadFile(%q) error = %v", path, err)
+		}
+	}
+}
+
+func TestEvaluateGenreEditors(t *testing.T) {
+	js, err := os.ReadFile(filepath.Join("examples", "genre_editors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := mustLoad(t, string(js))
+
+	// Member attributes are decoded from JSON, so their lists are []any.
+	dramaEditor := Attributes{"id": int64(1), "roles": []string{"editor"}, "genres": []any{"drama"}}
+	dramaViewer := Attributes{"id": int64(2), "roles": []string{"viewer"}, "genres": []any{"drama"}}
+	unassignedEditor := Attributes{"id": int64(3), "roles": []string{"editor"}}
+
+	tests := []struct {
+		name     string
+		subject  Attributes
+		action   string
+		resource Resource
+		want     bool
+	}{
+		{"editor updates a movie in their genre", dramaEditor, "movies:update", movie(9, "drama", "romance"), true},
+		{"editor updates a movie in another genre", dramaEditor, "movies:update", movie(9, "horror"), false},
+		{"editor deletes a movie in their genre", dramaEditor, "movies:delete", movie(9, "drama"), false},
+		{"non-editor with genres", dramaViewer, "movies:update", movie(9, "drama"), false},
+		{"editor without genres", unassignedEditor, "movies:update", movie(9, "drama"), false},
+		{"editor updates a movie without genres", dramaEditor, "movies:update", movie(9), false},
+		{"owner rule still applies", unassignedEditor, "movies:update", movie(3, "horror"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := e.Evaluate(tt.subject, tt.action, tt.resource)
+			if decision.Allowed != tt.want {
+				t.Errorf("Evaluate() = %+v; want allowed %t", decision, tt.want)
+			}
+		})
+	}
+}
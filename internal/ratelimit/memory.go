@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MemoryStore keeps a token bucket for each key in process memory. It's fast and needs
+// no other services, but each instance of the API has its own limits, and they are
+// forgotten when it restarts.
+type MemoryStore struct {
+	mu      sync.Mutex
+	clients map[string]*memoryClient
+}
+
+type memoryClient struct {
+	limiter  *rate.Limiter
+	limit    Limit
+	lastSeen time.Time
+}
+
+// NewMemoryStore() returns a new MemoryStore. It launches a background goroutine which
+// removes keys that haven't been seen for a while.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{clients: make(map[string]*memoryClient)}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			s.mu.Lock()
+
+			for key, client := range s.clients {
+				// A client is only safe to forget once its bucket has had time to
+				// refill completely.
+				idle := max(3*time.Minute, client.limit.Window())
+
+				if time.Since(client.lastSeen) > idle {
+					delete(s.clients, key)
+				}
+			}
+
+			s.mu.Unlock()
+		}
+	}()
+
+	return s
+}
+
+// Allow() takes a token from the key's bucket, if there is one.
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, found := s.clients[key]
+	if !found {
+		client = &memoryClient{
+			limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst),
+			limit:   limit,
+		}
+		s.clients[key] = client
+	}
+
+	// The same key may be checked against a different limit (for example, if it is
+	// shared by routes with different limits), so bring the bucket up to date.
+	if client.limit != limit {
+		client.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+		client.limiter.SetBurstAt(now, limit.Burst)
+		client.limit = limit
+	}
+
+	client.lastSeen = now
+
+	result := Result{
+		Allowed: client.limiter.AllowN(now, 1),
+		Limit:   limit.Burst,
+	}
+
+	tokens := client.limiter.TokensAt(now)
+
+	result.Remaining = max(int(math.Floor(tokens)), 0)
+	result.Reset = time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second))
+
+	if !result.Allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+
+	return result, nil
+}
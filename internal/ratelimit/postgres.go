@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps a sliding window for each key in the rate_limits table, so that
+// every instance of the API which uses the same database shares the same limits. Each
+// request takes a row lock on its key for the duration of a short transaction, so
+// concurrent requests for the same key are counted exactly.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore() returns a new PostgresStore. It launches a background goroutine
+// which removes the windows of keys that haven't been seen for a while.
+func NewPostgresStore(db *sql.DB, cleanupInterval time.Duration) *PostgresStore {
+	s := &PostgresStore{db: db}
+
+	go func() {
+		for {
+			time.Sleep(cleanupInterval)
+
+			// Expired rows are harmless (they are reset when the key is next seen),
+			// so if this fails we just try again next time.
+			_ = s.deleteExpired()
+		}
+	}()
+
+	return s
+}
+
+// Allow() counts a request in the key's window, if it is within the limit.
+func (s *PostgresStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	w := newWindow(now, limit.Window())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// Read the key's counts, creating its row if there isn't one yet. The no-op update
+	// locks the row until the transaction ends, so that concurrent requests for the
+	// same key take turns.
+	query := `
+        INSERT INTO rate_limits (key, window_start, previous_count, current_count, expires_at)
+        VALUES ($1, $2, 0, 0, $3)
+        ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+        RETURNING window_start, previous_count, current_count`
+
+	var (
+		start             time.Time
+		previous, current int
+	)
+
+	err = tx.QueryRowContext(ctx, query, key, w.start, w.start.Add(2*w.length)).Scan(&start, &previous, &current)
+	if err != nil {
+		return Result{}, err
+	}
+
+	w.advance(start, previous, current)
+
+	allowed := w.allows(now, limit)
+	if allowed {
+		w.current++
+	}
+
+	query = `
+        UPDATE rate_limits
+        SET window_start = $2, previous_count = $3, current_count = $4, expires_at = $5
+        WHERE key = $1`
+
+	_, err = tx.ExecContext(ctx, query, key, w.start, w.previous, w.current, w.start.Add(2*w.length))
+	if err != nil {
+		return Result{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return w.result(now, limit, allowed), nil
+}
+
+// The deleteExpired() method removes the rows for keys whose requests no longer count
+// towards their limit.
+func (s *PostgresStore) deleteExpired() error {
+	query := `
+        DELETE FROM rate_limits
+        WHERE expires_at < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,145 @@
+// Package ratelimit limits how often clients can make requests. The state of each
+// client's limit is kept in a Store, so that it can either live in process memory or
+// be shared by every instance of the API, using PostgreSQL or a server which speaks the
+// Redis protocol.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// A Limit allows requests at an average of Rate per second, with bursts of up to Burst
+// requests.
+//
+// The in-memory store enforces it with a token bucket. The shared stores use a sliding
+// window of Burst/Rate seconds, in which at most Burst requests are allowed, which
+// gives the same average rate.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Window returns the length of the sliding window used to enforce the limit, rounded
+// to a whole number of milliseconds (and at least one).
+func (l Limit) Window() time.Duration {
+	window := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	return max(window.Round(time.Millisecond), time.Millisecond)
+}
+
+// A Result describes the outcome of a request for a key. Remaining is the number of
+// further requests which would be allowed straight away, and Reset is how long it will
+// take for the key to have its full Limit available again. If the request wasn't
+// allowed, RetryAfter is how long the client should wait before trying again.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// A Store records the requests made for each key (such as a client's IP address), and
+// decides whether each new request is within the limit. Requests which aren't allowed
+// don't count towards the limit.
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// The window type holds the request counts for a key in the current fixed window and
+// the one before it. Windows start at multiples of their length since the Unix epoch,
+// so that every instance agrees on where they start.
+//
+// The number of requests made in the sliding window which ends now is estimated by
+// assuming that the requests in the previous window were spread evenly across it: all
+// of the requests in the current window are counted, along with the fraction of those
+// in the previous window which the sliding window still overlaps.
+type window struct {
+	start    time.Time
+	length   time.Duration
+	previous int
+	current  int
+}
+
+// The newWindow() function returns the window of the given length which contains now,
+// with no requests recorded.
+func newWindow(now time.Time, length time.Duration) window {
+	start := time.UnixMilli(now.UnixMilli() - now.UnixMilli()%length.Milliseconds())
+	return window{start: start, length: length}
+}
+
+// The advance() method takes counts which were recorded for the window starting at
+// start, and moves them into w, which must be the same window or a later one.
+func (w *window) advance(start time.Time, previous, current int) {
+	switch {
+	case start.Equal(w.start):
+		w.previous, w.current = previous, current
+	case start.Equal(w.start.Add(-w.length)):
+		w.previous, w.current = current, 0
+	default:
+		w.previous, w.current = 0, 0
+	}
+}
+
+// The estimate() method returns the estimated number of requests made in the sliding
+// window which ends at now.
+func (w window) estimate(now time.Time) float64 {
+	weight := 1 - float64(now.Sub(w.start))/float64(w.length)
+	return float64(w.previous)*max(weight, 0) + float64(w.current)
+}
+
+// The allows() method reports whether one more request is within the limit at now.
+func (w window) allows(now time.Time, limit Limit) bool {
+	return w.estimate(now)+1 <= float64(limit.Burst)
+}
+
+// The result() method describes the state of the window at now, after the request has
+// been counted (if it was allowed).
+func (w window) result(now time.Time, limit Limit, allowed bool) Result {
+	elapsed := now.Sub(w.start)
+	used := w.estimate(now)
+
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: max(int(math.Floor(float64(limit.Burst)-used)), 0),
+	}
+
+	// Requests in the current window stop counting once the following window has
+	// passed, and those in the previous window once the current window has.
+	switch {
+	case w.current > 0:
+		result.Reset = 2*w.length - elapsed
+	case w.previous > 0:
+		result.Reset = w.length - elapsed
+	}
+
+	if !allowed {
+		result.RetryAfter = w.retryAfter(elapsed, limit)
+	}
+
+	return result
+}
+
+// The retryAfter() method returns how long after elapsed (the time since the start of
+// the window) it will be before one more request is within the limit.
+func (w window) retryAfter(elapsed time.Duration, limit Limit) time.Duration {
+	spare := float64(limit.Burst - 1)
+
+	// If there is room in the current window, wait until enough of the previous
+	// window's requests have slid out of the sliding window.
+	if w.current <= limit.Burst-1 {
+		if w.previous == 0 {
+			return 0
+		}
+
+		at := time.Duration((1 - (spare-float64(w.current))/float64(w.previous)) * float64(w.length))
+		return max(at-elapsed, 0)
+	}
+
+	// Otherwise, wait for the next window, in which the current window's requests
+	// become the previous window's.
+	at := time.Duration((1 - spare/float64(w.current)) * float64(w.length))
+	return w.length - elapsed + max(at, 0)
+}
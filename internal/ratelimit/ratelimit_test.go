@@ -0,0 +1,220 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// start is the beginning of a two-second window, used by the tests below.
+var start = time.UnixMilli(1_700_000_000_000)
+
+func TestLimitWindow(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  time.Duration
+	}{
+		{Limit{Rate: 2, Burst: 4}, 2 * time.Second},
+		{Limit{Rate: 0.1, Burst: 5}, 50 * time.Second},
+		{Limit{Rate: 3, Burst: 1}, 333 * time.Millisecond},
+		{Limit{Rate: 1e6, Burst: 1}, time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := tt.limit.Window(); got != tt.want {
+			t.Errorf("%+v.Window() = %s; want %s", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestNewWindow(t *testing.T) {
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.UnixMilli(12345), time.UnixMilli(12000)},
+		{time.UnixMilli(12000), time.UnixMilli(12000)},
+		{time.UnixMilli(13999), time.UnixMilli(12000)},
+		{start.Add(1500 * time.Millisecond), start},
+	}
+
+	for _, tt := range tests {
+		w := newWindow(tt.now, 2*time.Second)
+		if !w.start.Equal(tt.want) || w.length != 2*time.Second || w.previous != 0 || w.current != 0 {
+			t.Errorf("newWindow(%d) = %+v; want start %d", tt.now.UnixMilli(), w, tt.want.UnixMilli())
+		}
+	}
+}
+
+func TestWindowAdvance(t *testing.T) {
+	tests := []struct {
+		name         string
+		recorded     time.Time
+		wantPrevious int
+		wantCurrent  int
+	}{
+		{"same window", start, 3, 4},
+		{"previous window", start.Add(-2 * time.Second), 4, 0},
+		{"older window", start.Add(-4 * time.Second), 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := window{start: start, length: 2 * time.Second}
+			w.advance(tt.recorded, 3, 4)
+
+			if w.previous != tt.wantPrevious || w.current != tt.wantCurrent {
+				t.Errorf("advance() = %d, %d; want %d, %d", w.previous, w.current, tt.wantPrevious, tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestWindowEstimate(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous int
+		current  int
+		elapsed  time.Duration
+		want     float64
+	}{
+		{"empty", 0, 0, 0, 0},
+		{"start of window", 4, 1, 0, 5},
+		{"quarter through", 4, 0, 500 * time.Millisecond, 3},
+		{"half way", 4, 2, time.Second, 4},
+		{"end of window", 4, 2, 2 * time.Second, 2},
+		{"current only", 0, 3, 1500 * time.Millisecond, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := window{start: start, length: 2 * time.Second, previous: tt.previous, current: tt.current}
+
+			if got := w.estimate(start.Add(tt.elapsed)); got != tt.want {
+				t.Errorf("estimate() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowResult(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 4}
+
+	tests := []struct {
+		name     string
+		previous int
+		current  int
+		elapsed  time.Duration
+		want     Result
+	}{
+		{
+			name:    "first request",
+			current: 1,
+			want:    Result{Allowed: true, Limit: 4, Remaining: 3, Reset: 4 * time.Second},
+		},
+		{
+			name:     "previous window only",
+			previous: 4,
+			elapsed:  500 * time.Millisecond,
+			want:     Result{Allowed: true, Limit: 4, Remaining: 1, Reset: 1500 * time.Millisecond},
+		},
+		{
+			name:     "both windows",
+			previous: 2,
+			current:  1,
+			elapsed:  time.Second,
+			want:     Result{Allowed: true, Limit: 4, Remaining: 2, Reset: 3 * time.Second},
+		},
+		{
+			name:    "limit reached",
+			current: 4,
+			elapsed: 500 * time.Millisecond,
+			want:    Result{Allowed: true, Limit: 4, Remaining: 0, Reset: 3500 * time.Millisecond},
+		},
+		{
+			name:    "over the limit",
+			current: 4,
+			elapsed: 500 * time.Millisecond,
+			want: Result{
+				Limit:      4,
+				Remaining:  0,
+				Reset:      3500 * time.Millisecond,
+				RetryAfter: 2 * time.Second,
+			},
+		},
+		{
+			name:     "over the limit from the previous window",
+			previous: 4,
+			elapsed:  0,
+			want: Result{
+				Limit:      4,
+				Remaining:  0,
+				Reset:      2 * time.Second,
+				RetryAfter: 500 * time.Millisecond,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := window{start: start, length: 2 * time.Second, previous: tt.previous, current: tt.current}
+
+			got := w.result(start.Add(tt.elapsed), limit, tt.want.Allowed)
+			if got != tt.want {
+				t.Errorf("result() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowRetryAfter(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 4}
+	length := limit.Window()
+
+	tests := []struct {
+		name     string
+		previous int
+		current  int
+		elapsed  time.Duration
+		want     time.Duration
+	}{
+		{"room in both windows", 0, 2, 0, 0},
+		{"previous window sliding out", 4, 0, 0, 500 * time.Millisecond},
+		{"previous window already slid out", 4, 0, time.Second, 0},
+		{"previous and current windows", 4, 2, 0, 1500 * time.Millisecond},
+		{"current window full", 0, 4, 500 * time.Millisecond, 2 * time.Second},
+		{"current window full late on", 0, 4, 1500 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := window{start: start, length: length, previous: tt.previous, current: tt.current}
+
+			got := w.retryAfter(tt.elapsed, limit)
+			if got != tt.want {
+				t.Fatalf("retryAfter() = %s; want %s", got, tt.want)
+			}
+
+			// Waiting for the time given should be enough for one more request to be
+			// allowed, and no less would do.
+			at := start.Add(tt.elapsed + got)
+
+			later := newWindow(at, length)
+			later.advance(w.start, w.previous, w.current)
+
+			if !later.allows(at, limit) {
+				t.Errorf("request not allowed after waiting %s", got)
+			}
+
+			if got > time.Millisecond {
+				before := at.Add(-time.Millisecond)
+
+				earlier := newWindow(before, length)
+				earlier.advance(w.start, w.previous, w.current)
+
+				if earlier.allows(before, limit) {
+					t.Errorf("request allowed before waiting %s", got)
+				}
+			}
+		})
+	}
+}
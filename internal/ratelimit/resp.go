@@ -0,0 +1,282 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RESPStore keeps a sliding window for each key on a server which speaks the Redis
+// serialization protocol (RESP), such as Redis or Valkey, so that every instance of the
+// API which uses the same server shares the same limits. Only the GET, INCR, DECR and
+// PEXPIRE commands are used, so any compatible server (or a local stand-in for
+// testing) will do.
+//
+// Each window's count is incremented before the request is checked, and decremented
+// again if it isn't allowed, so concurrent requests for the same key may be denied
+// slightly early, but never let through over the limit.
+type RESPStore struct {
+	addr     string
+	password string
+	prefix   string
+	timeout  time.Duration
+	conns    chan *respConn
+}
+
+// NewRESPStore() returns a new RESPStore which connects to the server at addr (a
+// host:port pair), authenticating with password if it isn't empty. Up to poolSize idle
+// connections are kept open for reuse.
+func NewRESPStore(addr, password string, poolSize int) *RESPStore {
+	return &RESPStore{
+		addr:     addr,
+		password: password,
+		prefix:   "greenlight:ratelimit:",
+		timeout:  time.Second,
+		conns:    make(chan *respConn, poolSize),
+	}
+}
+
+// Ping() checks that the server can be reached.
+func (s *RESPStore) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, []string{"PING"})
+	return err
+}
+
+// Allow() counts a request in the key's window, if it is within the limit.
+func (s *RESPStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+	w := newWindow(now, limit.Window())
+
+	// The window's length is part of its key, so that keys checked against different
+	// limits don't share counts.
+	length := w.length.Milliseconds()
+	index := w.start.UnixMilli() / length
+	base := s.prefix + key + ":" + strconv.FormatInt(length, 10) + ":"
+	previousKey := base + strconv.FormatInt(index-1, 10)
+	currentKey := base + strconv.FormatInt(index, 10)
+
+	replies, err := s.do(ctx,
+		[]string{"GET", previousKey},
+		[]string{"INCR", currentKey},
+		[]string{"PEXPIRE", currentKey, strconv.FormatInt(2*length, 10)},
+	)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if replies[0] != nil {
+		w.previous, err = strconv.Atoi(string(replies[0].([]byte)))
+		if err != nil {
+			return Result{}, fmt.Errorf("ratelimit: invalid count for %s: %w", previousKey, err)
+		}
+	}
+
+	current, ok := replies[1].(int64)
+	if !ok {
+		return Result{}, fmt.Errorf("ratelimit: unexpected reply to INCR: %v", replies[1])
+	}
+
+	// Check the request as if it hadn't been counted yet, and uncount it if it isn't
+	// allowed.
+	w.current = int(current) - 1
+
+	allowed := w.allows(now, limit)
+	if allowed {
+		w.current++
+	} else {
+		_, err = s.do(ctx, []string{"DECR", currentKey})
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	return w.result(now, limit, allowed), nil
+}
+
+// The respError type is an error reply from the server.
+type respError string
+
+func (e respError) Error() string {
+	return "ratelimit: server error: " + string(e)
+}
+
+// The do() method sends a pipeline of commands to the server and returns their
+// replies, which are strings (for simple strings), int64s, []bytes (for bulk strings) or
+// nil. If any command fails, the first error is returned.
+func (s *RESPStore) do(ctx context.Context, commands ...[]string) ([]any, error) {
+	conn, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := conn.do(ctx, s.timeout, commands...)
+	if err != nil {
+		// The connection may be left part way through a reply, so don't reuse it
+		// unless the server just rejected a command.
+		var replyErr respError
+		if !errors.As(err, &replyErr) {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	s.put(conn)
+	return replies, err
+}
+
+// The get() method returns an idle connection from the pool, or opens a new one.
+func (s *RESPStore) get(ctx context.Context) (*respConn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &respConn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}
+
+	if s.password != "" {
+		_, err = conn.do(ctx, s.timeout, []string{"AUTH", s.password})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// The put() method returns a connection to the pool, or closes it if the pool is full.
+func (s *RESPStore) put(conn *respConn) {
+	select {
+	case s.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// The respConn type is a connection to the server, with buffers for reading replies
+// and writing commands.
+type respConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// The do() method sends a pipeline of commands and reads their replies.
+func (c *respConn) do(ctx context.Context, timeout time.Duration, commands ...[]string) ([]any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > timeout {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := c.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, args := range commands {
+		fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+
+		for _, arg := range args {
+			fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+
+	err = c.writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read every reply, even after an error reply, so that the connection is left
+	// ready for the next pipeline.
+	replies := make([]any, len(commands))
+
+	var firstErr error
+
+	for i := range commands {
+		replies[i], err = c.readReply()
+		if err != nil {
+			var replyErr respError
+			if !errors.As(err, &replyErr) {
+				return nil, err
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return replies, firstErr
+}
+
+// The readReply() method reads a single reply from the server.
+func (c *respConn) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, errors.New("ratelimit: empty reply from server")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+
+		_, err = io.ReadFull(c.reader, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	default:
+		return nil, fmt.Errorf("ratelimit: unexpected reply from server: %q", line)
+	}
+}
+
+// The readLine() method reads a line, without its trailing CRLF.
+func (c *respConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("ratelimit: malformed line from server: %q", line)
+	}
+
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,406 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The respServer type is an in-process stand-in for a Redis server, which implements
+// just the commands that RESPStore uses.
+type respServer struct {
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	expiries map[string]int64
+	conns    []net.Conn
+}
+
+// The newRESPServer() function starts a respServer on a local port, and returns it
+// along with its address. It is stopped when the test finishes.
+func newRESPServer(t *testing.T, password string) (*respServer, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &respServer{
+		password: password,
+		values:   map[string]string{},
+		expiries: map[string]int64{},
+	}
+
+	var wg sync.WaitGroup
+
+	// Close the listener along with any connections which the store has left open in
+	// its pool, so that the goroutines serving them finish.
+	t.Cleanup(func() {
+		ln.Close()
+
+		srv.mu.Lock()
+		for _, conn := range srv.conns {
+			conn.Close()
+		}
+		srv.mu.Unlock()
+
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				srv.serve(conn)
+			}()
+		}
+	}()
+
+	return srv, ln.Addr().String()
+}
+
+func (srv *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	authenticated := srv.password == ""
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		var reply string
+
+		switch {
+		case strings.EqualFold(args[0], "AUTH"):
+			if len(args) == 2 && args[1] == srv.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = srv.execute(args)
+		}
+
+		_, err = io.WriteString(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (srv *respServer) execute(args []string) string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := srv.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "INCR", "DECR":
+		n, _ := strconv.ParseInt(srv.values[args[1]], 10, 64)
+		if strings.EqualFold(args[0], "INCR") {
+			n++
+		} else {
+			n--
+		}
+		srv.values[args[1]] = strconv.FormatInt(n, 10)
+		return fmt.Sprintf(":%d\r\n", n)
+	case "PEXPIRE":
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		srv.expiries[args[1]] = ms
+		return ":1\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// The readCommand() function reads a command, sent as an array of bulk strings.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, errors.New("invalid command")
+	}
+
+	args := make([]string, n)
+
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+// The keys() method returns the counts stored for every key, and their expiries.
+func (srv *respServer) keys() (map[string]string, map[string]int64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	values := map[string]string{}
+	for k, v := range srv.values {
+		values[k] = v
+	}
+
+	expiries := map[string]int64{}
+	for k, v := range srv.expiries {
+		expiries[k] = v
+	}
+
+	return values, expiries
+}
+
+// The connections() method returns the number of connections that have been accepted.
+func (srv *respServer) connections() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return len(srv.conns)
+}
+
+// The windowKey() function returns the key that RESPStore stores the count for a
+// client's window in, offset windows after the one containing now.
+func windowKey(client string, limit Limit, now time.Time, offset int64) string {
+	w := newWindow(now, limit.Window())
+	length := w.length.Milliseconds()
+
+	return "greenlight:ratelimit:" + client + ":" + strconv.FormatInt(length, 10) + ":" +
+		strconv.FormatInt(w.start.UnixMilli()/length+offset, 10)
+}
+
+func TestRESPStorePing(t *testing.T) {
+	_, addr := newRESPServer(t, "")
+
+	store := NewRESPStore(addr, "", 2)
+
+	err := store.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRESPStoreAllow(t *testing.T) {
+	srv, addr := newRESPServer(t, "")
+
+	store := NewRESPStore(addr, "", 2)
+
+	// A window of 500 seconds, so that the test doesn't cross into the next one.
+	limit := Limit{Rate: 0.01, Burst: 5}
+	now := time.Now()
+
+	for i := range limit.Burst {
+		result, err := store.Allow(context.Background(), "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := limit.Burst - i - 1
+		if !result.Allowed || result.Limit != limit.Burst || result.Remaining != want {
+			t.Errorf("request %d: Allow() = %+v; want allowed with %d remaining", i+1, result, want)
+		}
+
+		if result.Reset <= limit.Window() || result.Reset > 2*limit.Window() {
+			t.Errorf("request %d: Reset = %s; want between %s and %s", i+1, result.Reset, limit.Window(), 2*limit.Window())
+		}
+	}
+
+	for i := range 3 {
+		result, err := store.Allow(context.Background(), "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Allowed || result.Remaining != 0 || result.RetryAfter <= 0 {
+			t.Errorf("request over the limit %d: Allow() = %+v; want denied with a retry after", i+1, result)
+		}
+	}
+
+	// Other keys have their own limits.
+	result, err := store.Allow(context.Background(), "other", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Allowed {
+		t.Errorf("other key: Allow() = %+v; want allowed", result)
+	}
+
+	// Requests which weren't allowed shouldn't be counted, and each count should expire
+	// after two windows.
+	values, expiries := srv.keys()
+	key := windowKey("client", limit, now, 0)
+
+	if values[key] != strconv.Itoa(limit.Burst) {
+		t.Errorf("count for %s = %q; want %d (stored keys: %v)", key, values[key], limit.Burst, values)
+	}
+
+	if want := 2 * limit.Window().Milliseconds(); expiries[key] != want {
+		t.Errorf("expiry for %s = %d; want %d", key, expiries[key], want)
+	}
+
+	// Connections are returned to the pool and reused.
+	if n := srv.connections(); n != 1 {
+		t.Errorf("server accepted %d connections; want 1", n)
+	}
+}
+
+func TestRESPStorePreviousWindow(t *testing.T) {
+	srv, addr := newRESPServer(t, "")
+
+	store := NewRESPStore(addr, "", 1)
+
+	// A window of nearly two months, after one so full that its requests fill the
+	// sliding window until nearly the end of this one.
+	limit := Limit{Rate: 1e-6, Burst: 5}
+	now := time.Now()
+
+	srv.mu.Lock()
+	srv.values[windowKey("client", limit, now, -1)] = "1000000"
+	srv.mu.Unlock()
+
+	result, err := store.Allow(context.Background(), "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > limit.Window() {
+		t.Errorf("Allow() = %+v; want denied with a retry after of up to %s", result, limit.Window())
+	}
+
+	// The denied request is uncounted.
+	values, _ := srv.keys()
+	if key := windowKey("client", limit, now, 0); values[key] != "0" {
+		t.Errorf("count for %s = %q; want 0", key, values[key])
+	}
+}
+
+func TestRESPStorePassword(t *testing.T) {
+	_, addr := newRESPServer(t, "secret")
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  string
+	}{
+		{"correct password", "secret", ""},
+		{"wrong password", "wrong", "WRONGPASS"},
+		{"no password", "", "NOAUTH"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewRESPStore(addr, tt.password, 1)
+
+			_, err := store.Allow(context.Background(), "client", Limit{Rate: 1, Burst: 1})
+
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Allow() error = %v; want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Allow() error = %v; want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRESPStoreErrorReply(t *testing.T) {
+	srv, addr := newRESPServer(t, "")
+
+	store := NewRESPStore(addr, "", 1)
+
+	// An error reply fails the pipeline, but the other replies are still read, so the
+	// connection stays usable.
+	replies, err := store.do(context.Background(), []string{"NOPE"}, []string{"PING"})
+
+	var replyErr respError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("do() error = %v; want a server error", err)
+	}
+
+	if len(replies) != 2 || replies[1] != "PONG" {
+		t.Errorf("do() replies = %v; want the PING reply to be read", replies)
+	}
+
+	err = store.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := srv.connections(); n != 1 {
+		t.Errorf("server accepted %d connections; want 1", n)
+	}
+}
+
+func TestRESPStoreUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := NewRESPStore(addr, "", 1)
+
+	_, err = store.Allow(context.Background(), "client", Limit{Rate: 1, Burst: 1})
+	if err == nil {
+		t.Error("Allow() succeeded with no server; want an error")
+	}
+}
@@ -0,0 +1,112 @@
+package totp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("totp: unknown encryption key")
+
+// KeyRing holds the AES-256 keys that shared secrets are encrypted with before they're
+// stored. The first key is used to encrypt new secrets, and every key can decrypt, so
+// a new key can be introduced without re-encrypting the secrets that already exist.
+type KeyRing struct {
+	ids   []string
+	aeads []cipher.AEAD
+}
+
+// ParseKeyRing parses a list of keys in the format "<kid>:<key>", where the key is a
+// base64-encoded 32-byte AES key (for example, the output of `openssl rand -base64 32`).
+func ParseKeyRing(specs []string) (*KeyRing, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("totp: at least one encryption key is required")
+	}
+
+	kr := &KeyRing{}
+
+	for _, spec := range specs {
+		kid, encoded, ok := strings.Cut(spec, ":")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("totp: encryption key %q must be in the format <kid>:<key>", spec)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			key, err = base64.RawURLEncoding.DecodeString(encoded)
+		}
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("totp: encryption key %q must be a base64-encoded 32-byte key", kid)
+		}
+
+		for _, id := range kr.ids {
+			if id == kid {
+				return nil, fmt.Errorf("totp: duplicate encryption key ID %q", kid)
+			}
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		kr.ids = append(kr.ids, kid)
+		kr.aeads = append(kr.aeads, aead)
+	}
+
+	return kr, nil
+}
+
+// Seal encrypts a user's secret with the current key. The result is the key ID, a
+// colon, then the nonce and ciphertext. The user ID is authenticated along with the
+// secret, so a sealed secret can't be copied to another user's credential.
+func (kr *KeyRing) Seal(userID int64, secret []byte) []byte {
+	aead := kr.aeads[0]
+
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	sealed := append([]byte(kr.ids[0]+":"), nonce...)
+
+	return aead.Seal(sealed, nonce, secret, additionalData(userID))
+}
+
+// Open decrypts a secret sealed by Seal for the same user.
+func (kr *KeyRing) Open(userID int64, sealed []byte) ([]byte, error) {
+	kid, rest, ok := bytes.Cut(sealed, []byte(":"))
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	for i, id := range kr.ids {
+		if id != string(kid) {
+			continue
+		}
+
+		aead := kr.aeads[i]
+		if len(rest) < aead.NonceSize() {
+			return nil, errors.New("totp: sealed secret is too short")
+		}
+
+		nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+		return aead.Open(nil, nonce, ciphertext, additionalData(userID))
+	}
+
+	return nil, ErrUnknownKey
+}
+
+func additionalData(userID int64) []byte {
+	return []byte("users_totp:" + strconv.FormatInt(userID, 10))
+}
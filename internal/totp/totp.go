@@ -0,0 +1,110 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// The parameters we use for every TOTP credential. These are the defaults from RFC
+// 6238, and the only values that many authenticator apps support.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+
+	// Skew is the number of time steps either side of the current one that we accept,
+	// to allow for clock drift and for codes entered just as they roll over.
+	Skew = 1
+
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random shared secret.
+func GenerateSecret() []byte {
+	secret := make([]byte, secretSize)
+	rand.Read(secret)
+	return secret
+}
+
+// EncodeSecret returns the secret in the unpadded base32 format that authenticator
+// apps expect users to type in.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI returns an otpauth:// URI for the secret, which authenticator apps can import
+// (usually by scanning it as a QR code).
+func URI(issuer, account string, secret []byte) string {
+	params := url.Values{}
+	params.Set("secret", EncodeSecret(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period.Seconds())))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+
+	return u.String()
+}
+
+// Step returns the time step number for the given time.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code returns the code for the given time step (RFC 4226 section 5.3).
+func Code(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range Digits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
+
+// Validate checks a code against the secret at time t, allowing for Skew steps of
+// clock drift. To stop a code from being replayed, codes from steps at or before
+// lastStep are rejected. If the code is valid, the step it matched is returned so
+// that the caller can record it as the new lastStep.
+func Validate(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(t)
+
+	for step := current - Skew; step <= current+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if hmac.Equal([]byte(Code(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
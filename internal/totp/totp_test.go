@@ -0,0 +1,119 @@
+package totp
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The secret used by the test vectors in RFC 6238 appendix B.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// The SHA-1 test vectors from RFC 6238 appendix B, truncated to six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if got != tt.want {
+			t.Errorf("Code at %d = %q; want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", Code(rfcSecret, current), 0, current, true},
+		{"previous step", Code(rfcSecret, current-1), 0, current - 1, true},
+		{"next step", Code(rfcSecret, current+1), 0, current + 1, true},
+		{"two steps ago", Code(rfcSecret, current-2), 0, 0, false},
+		{"two steps ahead", Code(rfcSecret, current+2), 0, 0, false},
+		{"replayed", Code(rfcSecret, current), current, 0, false},
+		{"earlier than last used", Code(rfcSecret, current-1), current - 1, 0, false},
+		{"later than last used", Code(rfcSecret, current), current - 1, current, true},
+		{"wrong code", "000000", 0, 0, false},
+		{"too short", Code(rfcSecret, current)[:Digits-1], 0, 0, false},
+		{"too long", Code(rfcSecret, current) + "0", 0, 0, false},
+		{"empty", "", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Make sure that the wrong code doesn't happen to be valid.
+			if tt.name == "wrong code" {
+				for step := current - Skew; step <= current+Skew; step++ {
+					if Code(rfcSecret, step) == tt.code {
+						t.Skip("wrong code is valid for this secret")
+					}
+				}
+			}
+
+			step, ok := Validate(rfcSecret, tt.code, now, tt.lastStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("Validate() = %d, %t; want %d, %t", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	old, err := ParseKeyRing([]string{"old:" + strings.Repeat("A", 43) + "="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := ParseKeyRing([]string{"new:" + strings.Repeat("B", 43) + "=", "old:" + strings.Repeat("A", 43) + "="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := old.Seal(1, rfcSecret)
+	if bytes.Contains(sealed, rfcSecret) {
+		t.Fatal("sealed secret contains the plaintext")
+	}
+
+	got, err := rotated.Open(1, sealed)
+	if err != nil || !bytes.Equal(got, rfcSecret) {
+		t.Errorf("Open() after rotation = %q, %v; want %q", got, err, rfcSecret)
+	}
+
+	if _, err := rotated.Open(2, sealed); err == nil {
+		t.Error("Open() succeeded for a different user")
+	}
+
+	if _, err := old.Open(1, rotated.Seal(1, rfcSecret)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open() with a retired key = %v; want ErrUnknownKey", err)
+	}
+
+	for _, specs := range [][]string{
+		nil,
+		{"nokid"},
+		{"short:" + strings.Repeat("A", 20)},
+		{"a:" + strings.Repeat("A", 43) + "=", "a:" + strings.Repeat("B", 43) + "="},
+	} {
+		if _, err := ParseKeyRing(specs); err == nil {
+			t.Errorf("ParseKeyRing(%q) succeeded; want an error", specs)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS token_family_denylist;
+
+DROP TABLE IF EXISTS token_denylist;
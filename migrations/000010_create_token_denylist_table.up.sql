@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+    jti text PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS token_family_denylist (
+    family text PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
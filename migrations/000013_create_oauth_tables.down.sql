@@ -0,0 +1,5 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS permissions;
+ALTER TABLE tokens DROP COLUMN IF EXISTS client_id;
+
+DROP TABLE IF EXISTS oauth_codes;
+DROP TABLE IF EXISTS oauth_clients;
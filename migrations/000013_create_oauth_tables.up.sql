@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    client_id text UNIQUE NOT NULL,
+    secret_hash bytea,
+    name text NOT NULL,
+    redirect_uris text[] NOT NULL,
+    scopes text[] NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash bytea PRIMARY KEY,
+    client_id bigint NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes text[] NOT NULL,
+    code_challenge text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS client_id bigint REFERENCES oauth_clients ON DELETE CASCADE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS permissions text[];
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    kind text NOT NULL,
+    subject text NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL,
+    locked_until timestamp(0) with time zone,
+    PRIMARY KEY (kind, subject)
+);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS impersonations;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS impersonator_id;
+
+ALTER TABLE users DROP COLUMN IF EXISTS deactivated;
+
+DELETE FROM permissions WHERE code = 'users:admin';
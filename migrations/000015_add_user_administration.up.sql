@@ -0,0 +1,18 @@
+INSERT INTO permissions (code)
+VALUES ('users:admin');
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated bool NOT NULL DEFAULT false;
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS impersonations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    admin_id bigint REFERENCES users ON DELETE SET NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    reason text NOT NULL,
+    ip text NOT NULL DEFAULT '',
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS impersonations_user_id_idx ON impersonations (user_id);
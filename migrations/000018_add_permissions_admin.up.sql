@@ -0,0 +1,15 @@
+INSERT INTO permissions (code)
+VALUES ('permissions:admin');
+
+-- Existing administrators keep the ability to manage permissions.
+INSERT INTO users_permissions
+SELECT users_permissions.user_id, new_permission.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+CROSS JOIN (SELECT id FROM permissions WHERE code = 'permissions:admin') AS new_permission
+WHERE permissions.code = 'users:admin';
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'permissions:admin';
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS roles_permissions_notify ON roles_permissions;
+DROP TRIGGER IF EXISTS users_roles_notify ON users_roles;
+DROP TRIGGER IF EXISTS users_permissions_notify ON users_permissions;
+
+DROP FUNCTION IF EXISTS notify_all_permissions_changed();
+DROP FUNCTION IF EXISTS notify_user_permissions_changed();
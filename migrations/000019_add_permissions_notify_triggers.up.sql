@@ -0,0 +1,36 @@
+-- Notify API instances when a user's permissions change, so that they can drop any
+-- cached copies. The payload is the user's ID.
+CREATE OR REPLACE FUNCTION notify_user_permissions_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM pg_notify('permissions_changed', OLD.user_id::text);
+    END IF;
+
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('permissions_changed', NEW.user_id::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Changing a role's permissions can affect any number of users, so the payload "*"
+-- asks instances to drop every cached entry.
+CREATE OR REPLACE FUNCTION notify_all_permissions_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('permissions_changed', '*');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_permissions_notify
+AFTER INSERT OR UPDATE OR DELETE ON users_permissions
+FOR EACH ROW EXECUTE FUNCTION notify_user_permissions_changed();
+
+CREATE TRIGGER users_roles_notify
+AFTER INSERT OR UPDATE OR DELETE ON users_roles
+FOR EACH ROW EXECUTE FUNCTION notify_user_permissions_changed();
+
+CREATE TRIGGER roles_permissions_notify
+AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON roles_permissions
+FOR EACH STATEMENT EXECUTE FUNCTION notify_all_permissions_changed();
@@ -0,0 +1,3 @@
+-- Attributes which authorization policy rules can use, such as the genres that an
+-- editor is assigned to.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS attributes jsonb NOT NULL DEFAULT '{}';
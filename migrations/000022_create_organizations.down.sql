@@ -0,0 +1,29 @@
+DELETE FROM permissions WHERE code = 'organizations:admin';
+
+-- Only the default organization's data can be kept.
+DELETE FROM movies WHERE org_id <> (SELECT id FROM organizations WHERE slug = 'default');
+DELETE FROM invitations WHERE org_id <> (SELECT id FROM organizations WHERE slug = 'default');
+DELETE FROM users_permissions WHERE org_id <> (SELECT id FROM organizations WHERE slug = 'default');
+DELETE FROM users_roles WHERE org_id <> (SELECT id FROM organizations WHERE slug = 'default');
+
+ALTER TABLE users_roles DROP CONSTRAINT users_roles_pkey;
+ALTER TABLE users_roles DROP COLUMN IF EXISTS org_id;
+ALTER TABLE users_roles ADD PRIMARY KEY (user_id, role_id);
+
+ALTER TABLE users_permissions DROP CONSTRAINT users_permissions_pkey;
+ALTER TABLE users_permissions DROP COLUMN IF EXISTS org_id;
+ALTER TABLE users_permissions ADD PRIMARY KEY (user_id, permission_id);
+
+ALTER TABLE invitations DROP COLUMN IF EXISTS org_id;
+
+DROP INDEX IF EXISTS movies_org_id_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS org_id;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS attributes jsonb NOT NULL DEFAULT '{}';
+UPDATE users SET attributes = organizations_users.attributes
+FROM organizations_users
+INNER JOIN organizations ON organizations.id = organizations_users.org_id
+WHERE organizations_users.user_id = users.id AND organizations.slug = 'default';
+
+DROP TABLE IF EXISTS organizations_users;
+DROP TABLE IF EXISTS organizations;
@@ -0,0 +1,78 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    slug citext UNIQUE NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS organizations_users (
+    org_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    attributes jsonb NOT NULL DEFAULT '{}',
+    PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organizations_users_user_id_idx ON organizations_users (user_id);
+
+-- Everything that already exists belongs to the default organization.
+INSERT INTO organizations (name, slug)
+VALUES ('Default', 'default');
+
+INSERT INTO organizations_users (org_id, user_id, attributes)
+SELECT organizations.id, users.id, users.attributes
+FROM organizations, users
+WHERE organizations.slug = 'default';
+
+-- Like permissions and roles, attributes are held per organization.
+ALTER TABLE users DROP COLUMN IF EXISTS attributes;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS org_id bigint REFERENCES organizations ON DELETE CASCADE;
+UPDATE movies SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE movies ALTER COLUMN org_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS movies_org_id_idx ON movies (org_id);
+
+ALTER TABLE invitations ADD COLUMN IF NOT EXISTS org_id bigint REFERENCES organizations ON DELETE CASCADE;
+UPDATE invitations SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE invitations ALTER COLUMN org_id SET NOT NULL;
+
+-- Permissions and roles are granted within an organization, and are taken away when
+-- the user leaves it.
+ALTER TABLE users_permissions ADD COLUMN IF NOT EXISTS org_id bigint;
+UPDATE users_permissions SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE users_permissions
+    ALTER COLUMN org_id SET NOT NULL,
+    DROP CONSTRAINT users_permissions_pkey,
+    ADD PRIMARY KEY (user_id, org_id, permission_id),
+    ADD FOREIGN KEY (org_id, user_id) REFERENCES organizations_users ON DELETE CASCADE;
+
+ALTER TABLE users_roles ADD COLUMN IF NOT EXISTS org_id bigint;
+UPDATE users_roles SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE users_roles
+    ALTER COLUMN org_id SET NOT NULL,
+    DROP CONSTRAINT users_roles_pkey,
+    ADD PRIMARY KEY (user_id, org_id, role_id),
+    ADD FOREIGN KEY (org_id, user_id) REFERENCES organizations_users ON DELETE CASCADE;
+
+-- Managing organizations (and the role definitions which they share) affects every
+-- organization, so it needs its own permission. It isn't part of the admin role, as
+-- then the administrators of any organization could give it to themselves. Instead it
+-- is granted to the existing administrators of the default organization.
+INSERT INTO permissions (code)
+VALUES ('organizations:admin');
+
+INSERT INTO users_permissions (user_id, org_id, permission_id)
+SELECT users_permissions.user_id, users_permissions.org_id, new_permission.id
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+CROSS JOIN (SELECT id FROM permissions WHERE code = 'organizations:admin') AS new_permission
+WHERE permissions.code = 'users:admin'
+UNION
+SELECT users_roles.user_id, users_roles.org_id, new_permission.id
+FROM users_roles
+INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+CROSS JOIN (SELECT id FROM permissions WHERE code = 'organizations:admin') AS new_permission
+WHERE permissions.code = 'users:admin';
@@ -0,0 +1,29 @@
+-- Audit events outlive the users and organizations that they refer to, so the IDs
+-- aren't foreign keys.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint,
+    impersonator_id bigint,
+    org_id bigint,
+    ip text NOT NULL,
+    request_id text NOT NULL,
+    action text NOT NULL,
+    resource_type text NOT NULL,
+    resource_id text NOT NULL,
+    before jsonb,
+    after jsonb
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX IF NOT EXISTS audit_events_org_id_idx ON audit_events (org_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS audit_events_resource_idx ON audit_events (resource_type, resource_id);
+
+INSERT INTO permissions (code)
+VALUES ('audit:read');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'audit:read';
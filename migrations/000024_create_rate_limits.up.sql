@@ -0,0 +1,11 @@
+-- Rate limit state is cheap to lose (clients just get a fresh window), so the table
+-- is unlogged to keep writes fast.
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    window_start timestamp(3) with time zone NOT NULL,
+    previous_count integer NOT NULL,
+    current_count integer NOT NULL,
+    expires_at timestamp(3) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_expires_at_idx ON rate_limits (expires_at);